@@ -4,14 +4,66 @@ Package fsUtils contains a set of useful utilities I have developed for working
 package fsUtils
 
 import (
-	"io/ioutil"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
+// pollInterval is how long a Monitor waits between reads of a directory
+// unless SetInterval has been called or a notification arrives first
+const pollInterval = 1000 * time.Millisecond
+
+/*
+ErrPollTimeout is reported when reading a directory takes longer than a Monitor's PollTimeout.
+*/
+var ErrPollTimeout = errors.New("fsUtils: poll timed out")
+
+/*
+ErrNotifyOverflow is passed to OnError when the platform drops change notifications because too many arrived at once. The monitor polls straight away to find the changes they would have woken it for.
+*/
+var ErrNotifyOverflow = errors.New("fsUtils: change notifications overflowed")
+
+/*
+ErrRunning is returned by Start when the Monitor is already running.
+*/
+var ErrRunning = errors.New("fsUtils: monitor already running")
+
+/*
+ErrInvalidInterval is returned by SetInterval when it is given an interval that is not positive.
+*/
+var ErrInvalidInterval = errors.New("fsUtils: interval must be positive")
+
+/*
+ErrCallbackPanic is wrapped by the error passed to OnError when a callback panics.
+*/
+var ErrCallbackPanic = errors.New("fsUtils: callback panicked")
+
+/*
+ErrNotDirectory is returned by Directory when the path it is given exists but is not a directory.
+*/
+var ErrNotDirectory = errors.New("fsUtils: not a directory")
+
+/*
+ErrEmptyMount is passed to OnError when Directory starts on an empty directory that is the root of a mounted filesystem, which often means a network mount has gone away.
+*/
+var ErrEmptyMount = errors.New("fsUtils: empty mountpoint")
+
 /*
 Monitor is a structure that keeps track of the contents of a directory alerting the program when changes occure.
 
 An example of how to monitor a directory named "test":
+
 	func main() {
 		var m fsUtils.Monitor
 		err := m.Directory("test",testAdd,testDel)
@@ -29,119 +81,2397 @@ An example of how to monitor a directory named "test":
 	}
 */
 type Monitor struct {
-	contents map[string]bool
+	MonitorOptions
+
+	//Recursive watches the whole tree below the directory instead of just
+	//its top level. Names are reported relative to the watched directory,
+	//like sub/dir/file, and a new subdirectory is picked up on the next
+	//poll with an add for it and everything already inside it. Removing a
+	//subdirectory reports a delete for everything that was in it.
+	//Symlinks to directories are reported but not followed. A subdirectory
+	//that cannot be read is passed to OnError and skipped for that poll.
+	//Directories left out by Exclude or IgnoreHidden are not descended
+	//into at all, so putting ".git", "node_modules" or "vendor" in Exclude
+	//saves the cost of walking them as well as their events.
+	Recursive bool
+
+	//Separator, if not zero, is put between the elements of the names
+	//given to callbacks, Filter, the Events channel and Since in place of
+	//the platform's own separator, so for example '/' gives the same names
+	//on Windows as elsewhere. It only affects names with elements, as
+	//reported by Recursive and Subdirectories. Names are still tracked
+	//internally with the platform's separator.
+	Separator rune
+
+	//Granularity chooses between an event for every entry that changes,
+	//the default, and a single event for each directory something has
+	//changed in, which suits Recursive monitors that see bulk changes and
+	//would rather rescan a directory than hear about every file in it.
+	Granularity Granularity
+
+	//OrderDirs, if set, orders the events of a GranularityDirectory poll
+	//in place of sorting them by name, reporting whether the directory a
+	//belongs before b. It is given the names with the platform's
+	//separator, whatever Separator is. ByDepth delivers parents before
+	//the directories inside them.
+	OrderDirs func(a, b string) bool
+
+	//EmptyPolls guards against mounts that transiently report an empty
+	//listing. When greater than zero, a poll that comes back empty after a
+	//non-empty one is held until EmptyPolls consecutive polls agree before
+	//any deletes are reported. Zero disables the guard.
+	EmptyPolls int
+
+	//Coalesce, when greater than zero, holds changes back for a window of
+	//this length and delivers them together when it closes, merged so each
+	//file is reported at most once. The last change seen for a file wins,
+	//except that a file both added and deleted inside the window is not
+	//reported at all. A file deleted and added again is reported as
+	//modified, a file added and then modified is reported as added, and
+	//a rename is merged as a delete of the old name and an add of the new
+	//one. The initial listing is never held back.
+	Coalesce time.Duration
+
+	//OnDirTouch, if set, is called with the watched directory's own
+	//FileInfo whenever its modification time changes between polls.
+	OnDirTouch func(info os.FileInfo)
+
+	//Concurrency is the number of goroutines used to run callbacks for the
+	//changes found in a single poll. The monitor waits for every callback
+	//in a batch to return before polling again, so batches never overlap,
+	//but callbacks within a batch run in no particular order. Zero or one
+	//runs callbacks serially in the monitor's goroutine. When OnError is
+	//set, a panic in a callback is recovered, whether or not the batch
+	//runs concurrently, and treated as the callback failing: the panic is
+	//passed to OnError wrapping ErrCallbackPanic and the change is
+	//delivered again as DirectoryErr describes. Without OnError nothing
+	//could hear of it, so a panic is left alone when callbacks run
+	//serially, and with Concurrency greater than one it is raised again
+	//from the monitor's goroutine once the batch is done.
+	Concurrency int
+
+	//StartupGrace, when greater than zero, keeps the monitor quiet for
+	//that long after Directory starts, so a program's own churn while it
+	//sets up is not reported back to it. During the grace period the
+	//monitor keeps tracking the directory but delivers nothing, not even
+	//the initial listing; afterwards it reports changes from wherever the
+	//directory then stands. A file that is created and deleted again
+	//during the grace period is never reported, and neither is the
+	//deletion of a file that existed at startup if it is deleted during
+	//the grace period.
+	StartupGrace time.Duration
+
+	//InitialBatchDelay, when greater than zero, paces out delivery of the
+	//initial listing so that a directory with many files does not fire
+	//them all at once. The listing is delivered InitialBatchSize changes
+	//at a time, one at a time if InitialBatchSize is zero, with a pause of
+	//InitialBatchDelay between batches. Polling for further changes only
+	//begins once the whole listing has been delivered.
+	InitialBatchDelay time.Duration
+	InitialBatchSize  int
+
+	//StreamChunk, when greater than zero, has each poll read the directory
+	//StreamChunk entries at a time and diff them as they arrive, instead of
+	//reading the whole listing before diffing it. Only the monitor's own
+	//record of each file is kept, which bounds memory for directories with
+	//millions of entries. The initial listing is not streamed, so it
+	//still holds every entry read from the directory at once. Adds are
+	//then reported in the order the filesystem returns entries rather
+	//than by name. PollTimeout is checked between chunks. Recursive and
+	//Subdirectories listings ignore StreamChunk.
+	StreamChunk int
+
+	//PollTimeout, when greater than zero, bounds how long a single read of
+	//the directory may take. A poll that runs over is abandoned and
+	//ErrPollTimeout is passed to OnError; nothing from it is committed, so
+	//the next poll diffs against the same state as if the slow poll never
+	//happened. A timeout while taking the initial listing is returned from
+	//Directory. The read that ran over is left to finish in the
+	//background and a new one is not started while it is still going:
+	//later polls wait up to PollTimeout again for the same read and use
+	//its listing once it finishes, so a hung filesystem never has more
+	//than one read outstanding.
+	PollTimeout time.Duration
+
+	//SkipActive, when greater than zero, holds back reporting a new file,
+	//or a change to one already tracked, until its modification time is
+	//at least SkipActive in the past, so files that are still being
+	//written are not picked up half finished and a file being rewritten
+	//is reported as modified once rather than at every poll. A held back
+	//new file that is deleted before it goes quiet is never reported at
+	//all.
+	SkipActive time.Duration
+
+	//IgnoreOnAdd and IgnoreOnDelete hold filepath.Match patterns for
+	//files whose adds or deletes respectively should not be delivered,
+	//so that for example "*.tmp" files can be ignored as they appear but
+	//still reported when they go away. Patterns are matched against the
+	//base name of the file. Like Filter, they only affect delivery, and
+	//they are checked before Filter is consulted. Modifies and renames
+	//are not matched against either list.
+	IgnoreOnAdd    []string
+	IgnoreOnDelete []string
+
+	//Filter, if set, is asked about every event just before it is
+	//delivered, and events it returns false for are dropped. Filtering
+	//only affects delivery; a dropped event still updates what the
+	//monitor is tracking.
+	Filter func(ev Event) bool
+
+	//OnMarker, if set, is called for every zero byte regular file that is
+	//added, after the add itself has been delivered. It is a convenience
+	//for directories that use empty files as signals.
+	OnMarker func(name string)
+
+	//OnStable, if set, is called once when a regular file that has been
+	//growing stops, meaning its size changed between two polls and was
+	//then the same in two consecutive polls. It suits uploads whose
+	//length is not known up front. A file that is complete when it is
+	//first seen has not been seen growing, so it is not reported, and
+	//neither are directories or other entries that are not regular
+	//files. Sizes are only compared when the monitor stats its entries,
+	//so OnStable is never called when SkipStat is set.
+	OnStable func(name string, info os.FileInfo)
+
+	//OnModify, if set, is called by Directory and DirectoryErr with the
+	//name of a tracked file whose size or modification time has changed
+	//since the last poll, such as a file rewritten in place, or of an
+	//entry that has been replaced by one of another type, such as a file
+	//by a directory. A directory's own size and modification time are
+	//not compared, since they change with its contents. The Watch
+	//options add further details to compare, and Event.Changed says
+	//which differed. Nothing is reported as modified when SkipStat is
+	//set. Events from Start report these changes with Op set to Modify.
+	OnModify func(name string)
+
+	//HashContents keeps a SHA-256 of every regular file being tracked,
+	//so that a file whose modification time changes without its contents
+	//changing is not reported as modified, and so that DetectRenames can
+	//match files by content. Files are read in full when they are added
+	//or change, and that reading is not bounded by PollTimeout.
+	HashContents bool
+
+	//SplitRewrites reports a file whose contents look to have been
+	//replaced, rather than edited, as a delete followed by an add instead
+	//of a modify, for consumers such as content-addressed stores that
+	//treat new contents as a new object. It needs HashContents. A file
+	//counts as replaced when its hash has changed and its size has moved
+	//by more than RewriteThreshold bytes either way, so smaller changes,
+	//such as a short append or an edit in place, are still reported as
+	//modifies. The split is made just before delivery, after Coalesce and
+	//Debounce have merged changes.
+	SplitRewrites    bool
+	RewriteThreshold int64
+
+	//WatchLinks also reports a file as modified when its hard link count
+	//changes, such as when a new link to it is made elsewhere. It does
+	//nothing on platforms that do not report link counts.
+	WatchLinks bool
+
+	//WatchOwnership also reports an entry as modified when its owning
+	//user or group changes, which applies to directories as well as
+	//files. It does nothing on platforms that do not report ownership.
+	WatchOwnership bool
+
+	//WatchMode also reports an entry as modified when its permission
+	//bits change, directories included.
+	WatchMode bool
+
+	//DetectRenames pairs up a delete and an add found in the same poll
+	//that look like the same file and reports them as one Rename event,
+	//with the old name in OldName. On Unix the two must share an inode,
+	//and files must also keep their size and modification time;
+	//elsewhere they must have the same size and modification time, and
+	//the same contents when HashContents is set. A pair that cannot be
+	//told apart from another is left as a delete and an add. Renames are
+	//only detected when the monitor stats its entries, so not with
+	//SkipStat. With Recursive or Subdirectories a move from one directory
+	//to another is paired in the same way, so moving dirA/x to dirB/x
+	//arrives as a rename with OldName dirA/x.
+	DetectRenames bool
+
+	//OnRename, if set, is called by Directory and DirectoryErr for the
+	//renames found by DetectRenames. Without it, a rename is delivered to
+	//the callbacks as a delete of the old name followed by an add of the
+	//new one.
+	OnRename func(oldName, newName string)
+
+	//FullSyncInterval and OnFullSync provide periodic snapshots for
+	//consumers that may have missed events and need to reconcile. When
+	//both are set, OnFullSync is called roughly every FullSyncInterval,
+	//after that poll's changes have been delivered, with an Add event for
+	//every entry being tracked, sorted by name. Snapshots are separate
+	//from the normal event stream and are neither filtered nor numbered.
+	FullSyncInterval time.Duration
+	OnFullSync       func(snapshot []Event)
+
+	//OnPoll, if set, is called after every poll with a summary of the
+	//changes it found, before any Coalesce or Filter is applied. The
+	//initial listing is not a poll and is not summarised.
+	OnPoll func(stats PollStats)
+
+	//OnCount, if set, is called with the number of entries being tracked
+	//whenever it differs from the count after the previous poll, starting
+	//with the count from the initial listing.
+	OnCount func(n int)
+
+	//SkipStat leaves out the stat the monitor otherwise makes of every
+	//entry on every poll, which matters for very large directories.
+	//Events then carry the os.DirEntry from the listing in Entry and Info
+	//is left nil, so the callback can stat only what it needs. Options
+	//that need file details, such as SkipActive and OnMarker, still stat
+	//the entries they look at, and deletes report no size to OnPoll.
+	SkipStat bool
+
+	//Reference, if set, names a directory whose contents the watched
+	//directory is expected to match. It is listed once when Directory
+	//starts and used as the baseline in place of the watched directory's
+	//own listing. The first poll then reports the drift between the two:
+	//files the reference lacks as adds and files missing from the watched
+	//directory as deletes, and files that differ in size or modification
+	//time, or in contents with HashContents, as modifies. Later events
+	//report the drift changing, so a missing file being restored arrives
+	//as an add. Reference takes precedence over StateFile and Seed.
+	Reference string
+
+	//StateFile, if set, is where the monitor keeps the names it is
+	//tracking, along with the size, modification time and, with
+	//HashContents, hash of each, so that a restarted program picks up
+	//where it left off. When Directory starts it seeds itself from the
+	//file, as if Seed had been called, and only hashes again the files
+	//whose size or modification time no longer match what was saved.
+	//Saved names that have gone from the directory are reported as
+	//deleted by the first poll and dropped from the file when it is next
+	//written. The file is rewritten after every poll that finds
+	//changes, once they have been delivered, and again when monitoring is
+	//stopped through Stop or a context. A missing or unreadable file
+	//falls back to a fresh listing, reporting the problem to OnError
+	//unless the file simply does not exist yet. Changes still held back by
+	//Coalesce when the program stops are lost.
+	StateFile string
+
+	//MaxRetries caps how many times DirectoryErr redelivers a change
+	//whose callback returned an error. Once a change has failed that many
+	//retries it is treated as handled and the last error is passed to
+	//OnError. Zero retries until the callback succeeds.
+	MaxRetries int
+
+	//History is how many of the most recently delivered events the
+	//monitor keeps for Since. Zero keeps none.
+	History int
+
+	//PollOnly turns off native change notifications. Normally the
+	//monitor asks the platform to tell it when the directory changes,
+	//using inotify on Linux, kqueue on BSD and macOS and
+	//ReadDirectoryChangesW on Windows, and polls shortly after each
+	//notification instead of waiting out the poll interval. It still
+	//polls at the interval too, to catch anything the notifications
+	//miss, so with notifications the interval can be raised with
+	//SetInterval to save work on large directories. On BSD and macOS
+	//only entries being added, removed or renamed are notified, so
+	//changes to files already there are found by the regular polls. Where
+	//notifications are unavailable, or cannot be set up, the monitor
+	//polls alone; a failure to set them up is passed to OnError. When the
+	//platform reports that it dropped notifications, ErrNotifyOverflow is
+	//passed to OnError and the monitor polls at once.
+	PollOnly bool
+
+	//OnBackendChange, if set, is called from the monitor's goroutine
+	//with the name Backend would return whenever it changes while the
+	//monitor is running: once when monitoring starts, and again if the
+	//monitor later has to fall back to polling. Events are unaffected by
+	//the switch.
+	OnBackendChange func(backend string)
+
+	//OnError, if set, is called with errors the monitor carries on past,
+	//such as ErrPollTimeout. Errors it cannot carry on past are returned
+	//from Directory. Calls are made one at a time, though not always from
+	//the same goroutine: Tail reports files it cannot open from whichever
+	//goroutine is running the callback.
+	OnError func(err error)
+
+	contents   map[string]*entry
+	empties    int
+	coalescing window
+	debouncing window
+	dirInfo    os.FileInfo
+	seeded     bool
+	mu         sync.Mutex //guards the fields from interval to backend
+	interval   time.Duration
+	size       int64
+	lastPoll   time.Time
+	seq        uint64
+	history    []Event
+	events     chan Event
+	cancel     context.CancelFunc
+	done       chan struct{}
+	stopErr    error
+	backend    string
+	stable     []Event
+	counted    bool
+	count      int
+	routes     map[string]func(Event)
+	retries    map[string]int
+	subdirs    string       //pattern given to Subdirectories
+	reading    chan listing //a read that ran over PollTimeout and is still going
+	readingDir string
+	dir        string     //directory being watched, for Event.Dir
+	reporting  sync.Mutex //keeps calls to OnError one at a time
+}
+
+/*
+MonitorOptions narrows down which entries a Monitor reports and settles rapid changes to them. It is embedded in Monitor, so its fields are usually set on the Monitor directly.
+
+Entries left out by Include, Exclude and IgnoreHidden are not tracked at all, unlike events dropped by Filter, so they never count towards TotalSize or OnCount and are not hashed or saved to StateFile, and a Recursive monitor does not descend into excluded directories. Patterns are path.Match patterns matched against names as they are reported, with slashes as separators. A pattern containing a slash is matched against the whole name and any other pattern against the base name.
+*/
+type MonitorOptions struct {
+	//Include, if not empty, leaves out every file that matches none of
+	//its patterns. Directories are not subject to Include.
+	Include []string
+
+	//Exclude leaves out every entry that matches one of its patterns,
+	//along with everything below it, and takes precedence over Include.
+	//A pattern without a slash is matched against every element of the
+	//name, so "*.swp" leaves out swap files anywhere and ".git" leaves
+	//out a .git directory and everything in it.
+	Exclude []string
+
+	//IgnoreHidden leaves out entries whose names start with a dot, along
+	//with everything in hidden directories.
+	IgnoreHidden bool
+
+	//Debounce, when greater than zero, holds back the changes to each
+	//file until the file has gone Debounce without changing again, then
+	//delivers them merged into one, the way Coalesce does. Unlike
+	//Coalesce's window, the wait is kept separately for every file and
+	//starts over with each change, so a file written in several bursts
+	//is reported once the bursts stop. Changes are only noticed when the
+	//monitor polls, so the wait is counted from the poll that found the
+	//latest change. Changes still held back when the program stops are
+	//lost.
+	Debounce time.Duration
+}
+
+/*
+Op describes what happened to a file in an Event. Modify and Rename are only reported as described for OnModify and DetectRenames.
+*/
+type Op int
+
+const (
+	Add Op = iota
+	Delete
+	Modify
+	Rename
+)
+
+/*
+Granularity says what the events a Monitor delivers name.
+
+With GranularityDirectory, each poll delivers one Modify for every directory that had an entry added, removed, renamed in or out of it, or modified, naming the directory instead of the entries, with the watched directory itself named ".". Changes in a directory that has itself gone are counted towards its nearest parent that has not. The events carry the directory's Info and Entry when it is being tracked, and Changed is zero. They are sorted by name, or by OrderDirs when it is set, and the initial listing is grouped the same way. Directory and DirectoryErr pass them to OnModify. A directory event that is not received before Stop, or that fails, has the changes it stands for found again at the next poll, as DirectoryErr describes.
+*/
+type Granularity int
+
+const (
+	GranularityFile Granularity = iota
+	GranularityDirectory
+)
+
+/*
+Changes is a set of the details of a file that a Modify found to have changed, so that a callback can pick out the changes it cares about.
+*/
+type Changes int
+
+const (
+	ChangedSize     Changes = 1 << iota
+	ChangedModTime          //the modification time
+	ChangedContents         //only known with HashContents
+	ChangedLinks            //the hard link count, with WatchLinks
+	ChangedOwner            //the owning user or group, with WatchOwnership
+	ChangedMode             //the permission bits, with WatchMode
+	ChangedType             //the kind of entry, such as a file becoming a directory
+)
+
+/*
+Event describes a single change to a monitored directory.
+*/
+type Event struct {
+	Name string
+	Op   Op
+
+	//Info is the file's FileInfo from the poll that found the change; for
+	//a delete it is the last FileInfo seen before the file went away. It
+	//is nil for deletes of names given to Seed that were never listed,
+	//and always nil when SkipStat is set.
+	Info os.FileInfo
+
+	//Seq numbers delivered events in the order they were delivered,
+	//starting from one. Events dropped by filtering are not numbered.
+	Seq uint64
+
+	//Entry is the os.DirEntry from the listing that found the change, or
+	//for a delete the last one seen. It is nil only for deletes of names
+	//given to Seed that were never listed.
+	Entry os.DirEntry
+
+	//OldName is the name a file had before a Rename, and is empty for
+	//every other Op.
+	OldName string
+
+	//Dir is the directory the Monitor that found the change watches, as
+	//given to Directory or Start, which tells apart the events of
+	//monitors combined with Merge.
+	Dir string
+
+	//Changed says which details of the file differ from the previous
+	//poll for a Modify, and is zero for every other Op. Changes merged by
+	//Coalesce or Debounce report the latest poll's.
+	Changed Changes
+
+	prev    *entry  //what was tracked before a Modify, Rename or Delete
+	grouped []Event //the changes a GranularityDirectory event stands for
+}
+
+/*
+Links returns the number of hard links to the file an Event describes. The boolean is false when the platform does not report link counts or the Event has no Info.
+*/
+func (e Event) Links() (uint64, bool) {
+	return linkCount(e.stat())
+}
+
+/*
+Owner returns the user and group ids that own the file an Event describes. The boolean is false when the platform does not report ownership or the Event has no Info.
+*/
+func (e Event) Owner() (uid int, gid int, ok bool) {
+	return owner(e.stat())
+}
+
+/*
+EntryType classifies the kind of file an Event describes.
+*/
+type EntryType int
+
+const (
+	TypeUnknown EntryType = iota
+	TypeRegular
+	TypeDir
+	TypeSymlink
+	TypeFIFO
+	TypeSocket
+	TypeDevice
+	TypeOther
+)
+
+/*
+Type classifies the file an Event describes from its mode bits. Character and block devices are both TypeDevice. Symlinks are reported as TypeSymlink, not followed. TypeUnknown is returned when the Event has neither Info nor Entry.
+*/
+func (e Event) Type() EntryType {
+	var mode os.FileMode
+	switch {
+	case e.Info != nil:
+		mode = e.Info.Mode()
+	case e.Entry != nil:
+		mode = e.Entry.Type()
+	default:
+		return TypeUnknown
+	}
+
+	switch {
+	case mode&os.ModeSymlink != 0:
+		return TypeSymlink
+	case mode.IsDir():
+		return TypeDir
+	case mode&os.ModeNamedPipe != 0:
+		return TypeFIFO
+	case mode&os.ModeSocket != 0:
+		return TypeSocket
+	case mode&os.ModeDevice != 0:
+		return TypeDevice
+	case mode.IsRegular():
+		return TypeRegular
+	}
+	return TypeOther
+}
+
+// stat returns e.Info, statting e.Entry instead if SkipStat left Info nil
+func (e Event) stat() os.FileInfo {
+	if e.Info != nil || e.Entry == nil || e.Op == Delete {
+		return e.Info
+	}
+	info, err := e.Entry.Info()
+	if err != nil {
+		return nil
+	}
+	return info
+}
+
+/*
+PollStats summarises the changes found by a single poll. Byte counts only include regular files, and for deleted files use the last size the monitor saw. BytesModified is the net change in size of the modified files.
+*/
+type PollStats struct {
+	Added         int
+	Deleted       int
+	Modified      int
+	Renamed       int
+	BytesAdded    int64
+	BytesDeleted  int64
+	BytesModified int64
+}
+
+/*
+Net returns the change in bytes over the poll.
+*/
+func (p PollStats) Net() int64 {
+	return p.BytesAdded - p.BytesDeleted + p.BytesModified
 }
 
-type change struct {
-	Name    string
-	Deleted bool
+// entry is what a Monitor remembers about each file it is tracking
+type entry struct {
+	info    os.FileInfo
+	dirent  os.DirEntry
+	hash    string //SHA-256 of the contents, when HashContents is set
+	seen    bool   //whether the file turned up in the current poll
+	growing bool   //whether the size has changed since the file was last stable
+	saved   *saved //details from StateFile, until the file is listed again
+}
+
+// coalesced tracks the net change to a file while it is held back
+type coalesced struct {
+	Event
+	existed bool      //whether the file was present before the first change
+	prev    *entry    //what was tracked before the first change, if it existed
+	last    time.Time //when the latest change was found
+}
+
+// window holds back changes for Coalesce or Debounce, merging the changes
+// to each name
+type window struct {
+	held  []*coalesced //in the order the names were first changed
+	names map[string]*coalesced
+	start time.Time //when the oldest change still held was found
 }
 
 /*
 Directory causes a Monitor to begin monitoring a directory, calling the onAdd and onDelete callback functions when a change is detected.
+
+Callbacks are made in the order changes were detected. Every change from one poll is delivered before any change from the next, and within a poll adds and renames come first, in the order the directory listed them, then modifies in the same order, followed by deletes sorted by name. The initial listing is delivered sorted by name. Only Concurrency greater than one gives up ordering within a poll.
 */
 func (m *Monitor) Directory(directoryName string, onAdd func(string), onDelete func(string)) error {
-	//if onAdd or onDelete are nil assign dummy functions
-	if onAdd == nil {
-		onAdd = func(s string) {}
+	return m.DirectoryErr(directoryName, noError(onAdd), noError(onDelete))
+}
+
+/*
+DirectoryContext is like Directory, except that it stops monitoring and returns ctx's error once ctx is done.
+*/
+func (m *Monitor) DirectoryContext(ctx context.Context, directoryName string, onAdd func(string), onDelete func(string)) error {
+	err := m.preflight(directoryName)
+	if err != nil {
+		return err
 	}
+	return m.run(ctx, directoryName, m.byOp(noError(onAdd), noError(onDelete)))
+}
 
-	if onDelete == nil {
-		onDelete = func(s string) {}
+/*
+DirectoryErr is like Directory, except that the callbacks may fail. A change whose callback returns an error is not treated as handled: the monitor forgets it saw the change, so the next poll finds it again and delivers it again, until the callback succeeds or MaxRetries is reached. An add is only redelivered while the file is still there, and a delete only while the file is still gone. A rename delivered as a delete and an add is redelivered whole if either fails. OnModify and OnRename cannot fail. This gives at-least-once delivery, so callbacks should cope with seeing a change more than once.
+*/
+func (m *Monitor) DirectoryErr(directoryName string, onAdd func(string) error, onDelete func(string) error) error {
+	err := m.preflight(directoryName)
+	if err != nil {
+		return err
 	}
+	return m.run(context.Background(), directoryName, m.byOp(onAdd, onDelete))
+}
 
-	err := m.buildContents(directoryName)
+/*
+Start begins monitoring a directory in the background and returns straight away. Changes are delivered on the channel returned by Events, in the same order Directory would make its callbacks, and the monitor waits for each to be received before carrying on. Stop ends the monitoring. Start fails if the path is not a directory, or with ErrRunning if the Monitor has been started and not yet stopped, even if an error has since ended the monitoring.
+*/
+func (m *Monitor) Start(directoryName string) error {
+	err := m.preflight(directoryName)
 	if err != nil {
 		return err
 	}
 
-	handlechanges(m.contentArray(),onAdd,nil)
+	m.mu.Lock()
+	if m.cancel != nil {
+		m.mu.Unlock()
+		return ErrRunning
+	}
+	if m.events == nil {
+		m.events = make(chan Event)
+	}
+	events := m.events
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	m.cancel = cancel
+	m.done = done
+	m.mu.Unlock()
 
-	for {
-		time.Sleep(1000 * time.Millisecond)
-		change, err := m.getDiff(directoryName)
+	go func() {
+		defer close(done)
+		err := m.run(ctx, directoryName, func(ev Event) error {
+			select {
+			case events <- ev:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if errors.Is(err, context.Canceled) {
+			err = nil
+		}
 		if err != nil {
-			return err
+			m.report(err)
 		}
-		if len(change) > 0 {
-			handlechanges(change,onAdd,onDelete)
+		m.mu.Lock()
+		m.stopErr = err
+		m.mu.Unlock()
+		close(events)
+	}()
+	return nil
+}
+
+/*
+Events returns the channel that a Monitor started with Start delivers changes on. It can be called before Start. The channel is closed when monitoring ends, whether through Stop or an error, and a later Start delivers on a new channel.
+*/
+func (m *Monitor) Events() <-chan Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.events == nil {
+		m.events = make(chan Event)
+	}
+	return m.events
+}
+
+/*
+Stop ends monitoring begun by Start and waits for the monitor to finish, returning the error that ended it early, if any. Stop does nothing if the Monitor is not running.
+
+Starting the Monitor again lists the directory afresh, reporting everything in it as added as the first Start did, so changes that were being delivered but not yet received are only redelivered when StateFile is set. The restart then carries on from the saved state, which includes a pending delete.
+*/
+func (m *Monitor) Stop() error {
+	m.mu.Lock()
+	cancel, done := m.cancel, m.done
+	m.mu.Unlock()
+	if cancel == nil {
+		return nil
+	}
+
+	cancel()
+	<-done
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cancel = nil
+	m.done = nil
+	m.events = nil
+	return m.stopErr
+}
+
+/*
+Merge fans the events of monitors already started with Start into a single channel, so that one consumer can handle several directories. Each monitor's events arrive in their usual order, interleaved with the others', and carry the directory they are for in Dir. The channel is closed once every monitor has stopped, whether through the returned function or an error. Renames are only paired within a single monitor, so a file moved between the directories of two merged monitors arrives as a delete from one and an add from the other; watching their parent with Subdirectories reports such moves as renames. The returned function stops all of the monitors and waits for them to finish; events a monitor has delivered that have not yet been received from the merged channel by then are dropped. Monitors that are not running when Merge is called are left out, so if none are the channel is closed straight away.
+*/
+func Merge(monitors ...*Monitor) (<-chan Event, func()) {
+	merged := make(chan Event)
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, m := range monitors {
+		events, ok := m.running()
+		if !ok {
+			continue
 		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ev := range events {
+				select {
+				case merged <- ev:
+				case <-quit:
+					return
+				}
+			}
+		}()
 	}
+	go func() {
+		wg.Wait()
+		close(merged)
+	}()
 
-	return nil
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(quit)
+			for _, m := range monitors {
+				m.Stop()
+			}
+		})
+	}
+	return merged, stop
 }
 
-func handlechanges(changes []change, onAdd func(string), onDelete func(string)) {
-	for _,change := range changes {
-		if change.Deleted {
-			onDelete(change.Name)
-		} else {
-			onAdd(change.Name)
+// running returns the channel a Monitor started with Start delivers on,
+// and false if it is not running
+func (m *Monitor) running() (<-chan Event, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cancel == nil {
+		return nil, false
+	}
+	return m.events, true
+}
+
+// byOp adapts an onAdd and onDelete pair, along with OnModify, OnRename
+// and the handlers given to OnExt, to a single delivery function
+func (m *Monitor) byOp(onAdd func(string) error, onDelete func(string) error) func(Event) error {
+	//if onAdd or onDelete are nil assign dummy functions
+	if onAdd == nil {
+		onAdd = func(s string) error { return nil }
+	}
+
+	if onDelete == nil {
+		onDelete = func(s string) error { return nil }
+	}
+
+	return func(ev Event) error {
+		if handler, ok := m.routes[strings.ToLower(filepath.Ext(m.native(ev.Name)))]; ok {
+			handler(ev)
+			return nil
+		}
+		switch ev.Op {
+		case Delete:
+			return onDelete(ev.Name)
+		case Modify:
+			if m.OnModify != nil {
+				m.OnModify(ev.Name)
+			}
+			return nil
+		case Rename:
+			if m.OnRename != nil {
+				m.OnRename(ev.OldName, ev.Name)
+				return nil
+			}
+			if err := onDelete(ev.OldName); err != nil {
+				return err
+			}
 		}
+		return onAdd(ev.Name)
 	}
 }
 
-func (m *Monitor) buildContents(directoryName string) error {
-	folder, err := ioutil.ReadDir(directoryName)
+// run monitors directoryName until ctx is done, passing changes to deliver
+func (m *Monitor) run(ctx context.Context, directoryName string, deliver func(Event) error) error {
+	defer m.polledAt(time.Time{})
+	m.dir = directoryName
+
+	var err error
+	if m.Reference != "" {
+		err = m.seedReference(m.Reference)
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.StateFile != "" && !m.seeded {
+		state, err := loadState(m.StateFile)
+		if err == nil {
+			m.seedState(state)
+		} else if !os.IsNotExist(err) {
+			m.report(err)
+		}
+	}
+
+	//watch before listing so that nothing is missed in between
+	n := m.notify(directoryName)
+	m.setBackend(backendOf(n))
+	defer func() {
+		if n != nil {
+			n.close()
+		}
+		m.setBackend("")
+	}()
 
+	//a seeded monitor diffs straight away instead of listing everything
+	var initial []Event
+	if m.seeded {
+		m.seeded = false
+		initial, err = m.getDiff(directoryName)
+		if err == nil {
+			m.polled(initial)
+		}
+	} else {
+		err = m.buildContents(directoryName)
+		initial = m.group(m.contentArray())
+	}
 	if err != nil {
 		return err
 	}
 
-	m.contents = make(map[string]bool)
-	for _, file := range folder {
-		m.contents[file.Name()] = false
+	started := time.Now()
+	synced := started
+	quiet := func() bool {
+		return m.StartupGrace > 0 && time.Since(started) < m.StartupGrace
+	}
+
+	m.polledAt(time.Now())
+	if !quiet() {
+		m.retry(m.handleinitial(ctx, initial, deliver))
+	}
+	m.save()
+	m.counted = false
+	m.recount()
+
+	m.dirInfo = nil
+	err = m.checkDir(directoryName)
+	if err != nil {
+		return err
+	}
+	n = m.rewatch(n, directoryName)
+
+	for {
+		if !m.wait(ctx, n) {
+			m.save()
+			return ctx.Err()
+		}
+		change, err := m.getDiff(directoryName)
+		if errors.Is(err, ErrPollTimeout) {
+			m.report(err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		m.polledAt(time.Now())
+		m.polled(change)
+		m.recount()
+		err = m.checkDir(directoryName)
+		if err != nil {
+			return err
+		}
+		if len(change) > 0 {
+			n = m.rewatch(n, directoryName)
+		}
+		changed := len(change) > 0
+		if quiet() {
+			if changed {
+				m.save()
+			}
+			continue
+		}
+		if m.Coalesce > 0 {
+			change = m.coalesce(change, time.Now())
+		}
+		if m.Debounce > 0 {
+			change = m.debounce(change, time.Now())
+		}
+		if len(change) > 0 {
+			m.retry(m.handlechanges(change, deliver))
+		}
+		if changed {
+			m.save()
+		}
+		if m.OnStable != nil {
+			for _, ev := range m.stable {
+				m.OnStable(m.separate(ev.Name), ev.Info)
+			}
+		}
+		if m.OnFullSync != nil && m.FullSyncInterval > 0 && time.Since(synced) >= m.FullSyncInterval {
+			snapshot := m.contentArray()
+			for i := range snapshot {
+				snapshot[i] = m.reported(snapshot[i])
+				snapshot[i].Dir = directoryName
+			}
+			m.OnFullSync(snapshot)
+			synced = time.Now()
+		}
 	}
-	return nil
 }
 
-func (m *Monitor) contentArray() []change {
-	result := make([]change, len(m.contents))
-	i := 0
-	for key, _ := range m.contents {
-		result[i] = change{key, false}
-		i++
+// coalesce folds changes into the current window, returning the merged
+// result once the window has been open for m.Coalesce
+func (m *Monitor) coalesce(changes []Event, now time.Time) []Event {
+	m.coalescing.fold(changes, now)
+	if len(m.coalescing.held) == 0 || now.Sub(m.coalescing.start) < m.Coalesce {
+		return nil
 	}
-	return result
+	return m.coalescing.release(func(*coalesced) bool { return true })
 }
 
-func (m *Monitor) getDiff(directoryName string) ([]change, error) {
-	folder, err := ioutil.ReadDir(directoryName)
-	result := make([]change, 0, len(folder)+len(m.contents))
+// debounce folds changes into those being held for Debounce, returning
+// the merged changes to files that have settled
+func (m *Monitor) debounce(changes []Event, now time.Time) []Event {
+	m.debouncing.fold(changes, now)
+	return m.debouncing.release(func(c *coalesced) bool {
+		return now.Sub(c.last) >= m.Debounce
+	})
+}
 
-	if err != nil {
-		return nil, err
+// due returns how long until changes being held back are ready to be
+// released, and false if none are being held
+func (m *Monitor) due(now time.Time) (time.Duration, bool) {
+	var next time.Time
+	if len(m.coalescing.held) > 0 {
+		next = m.coalescing.start.Add(m.Coalesce)
 	}
+	for _, c := range m.debouncing.held {
+		if t := c.last.Add(m.Debounce); next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	if next.IsZero() {
+		return 0, false
+	}
+	return next.Sub(now), true
+}
 
-	i := 0 //index for result
-
-	//Ensure files are in contents already
-	for _, file := range folder {
-		_, ok := m.contents[file.Name()]
-		if !ok {
-			m.contents[file.Name()] = true
-			result = result[0 : len(result)+1]
-			result[i] = change{file.Name(), false}
-			i++
-		} else {
-			m.contents[file.Name()] = true
+// fold merges changes into w. A rename is merged as a delete of the old
+// name and an add of the new one.
+func (w *window) fold(changes []Event, now time.Time) {
+	if len(w.held) == 0 {
+		w.start = now
+	}
+	for _, c := range changes {
+		if c.Op == Rename {
+			w.merge(Event{Name: c.OldName, Op: Delete, Info: c.prev.info, Entry: c.prev.dirent, prev: c.prev}, now)
+			c = Event{Name: c.Name, Op: Add, Info: c.Info, Entry: c.Entry}
 		}
+		w.merge(c, now)
 	}
+}
 
-	//Check if files have been removed
-	for key, value := range m.contents {
-		if !value {
-			delete(m.contents, key)
-			result = result[0 : len(result)+1]
-			result[i] = change{key, true}
-			i++
+// merge folds a single change into w
+func (w *window) merge(c Event, now time.Time) {
+	if w.names == nil {
+		w.names = make(map[string]*coalesced)
+	}
+	h, ok := w.names[c.Name]
+	if !ok {
+		h = &coalesced{existed: c.Op != Add}
+		if h.existed {
+			h.prev = c.prev
 		}
+		w.names[c.Name] = h
+		w.held = append(w.held, h)
 	}
+	h.Event = c
+	h.last = now
+}
 
-	//Set files back to false
-	for key, _ := range m.contents {
-		m.contents[key] = false
+// release stops holding the names ready says can go, returning the net
+// change to each in the order they were first changed
+func (w *window) release(ready func(*coalesced) bool) []Event {
+	var result []Event
+	kept := w.held[:0]
+	for _, h := range w.held {
+		if !ready(h) {
+			kept = append(kept, h)
+			continue
+		}
+		delete(w.names, h.Name)
+		switch {
+		case !h.existed && h.Op == Delete:
+			continue
+		case !h.existed && h.Op == Modify:
+			h.Op = Add
+			h.Event.prev = nil
+		case h.existed && h.Op != Delete:
+			h.Op = Modify
+			h.Event.prev = h.prev
+		}
+		result = append(result, h.Event)
+	}
+	for i := len(kept); i < len(w.held); i++ {
+		w.held[i] = nil
 	}
+	w.held = kept
+	return result
+}
 
+/*
+Tail is like Directory, except that onAdd is handed each added regular file already open for reading, positioned at its start, or at its end when fromEnd is true. onAdd must close the reader. The monitor opens the file before calling onAdd, so a file removed after that can still be read to the end. Files that are gone before they can be opened are skipped, and other errors opening them are passed to OnError. Added entries that are not regular files are not reported.
+*/
+func (m *Monitor) Tail(directoryName string, fromEnd bool, onAdd func(name string, r io.ReadCloser), onDelete func(string)) error {
+	if onAdd == nil {
+		onAdd = func(s string, r io.ReadCloser) { r.Close() }
+	}
+
+	return m.Directory(directoryName, func(name string) {
+		r, err := openTail(filepath.Join(directoryName, m.native(name)), fromEnd)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				m.report(err)
+			}
+			return
+		}
+		if r != nil {
+			onAdd(name, r)
+		}
+	}, onDelete)
+}
+
+// openTail opens path for Tail, returning nil if it is not a regular file
+func openTail(path string, fromEnd bool) (io.ReadCloser, error) {
+	//check first, since opening a FIFO would block
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if fromEnd {
+		_, err = f.Seek(0, io.SeekEnd)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+/*
+Subdirectories monitors every subdirectory of parentName whose name matches pattern, as understood by filepath.Match, calling onAdd and onDelete for changes to their contents. Names are reported relative to parentName, so a file x in the matching subdirectory tenant appears as tenant/x. A matching subdirectory created later is picked up on the next poll with an add for each of its files, and one that is removed or renamed away produces a delete for each file it held. With DetectRenames, a file moved from one matching subdirectory to another within a poll is reported as a rename between the two names. Anything else in parentName is ignored.
+*/
+func (m *Monitor) Subdirectories(parentName string, pattern string, onAdd func(string), onDelete func(string)) error {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return err
+	}
+	m.subdirs = pattern
+	return m.Directory(parentName, onAdd, onDelete)
+}
+
+/*
+Seed primes a Monitor with names the caller already knows to be in the directory, and must be called before Directory. Directory then skips reporting its initial listing and instead reports only how the directory differs from the seeded names, starting with an immediate poll.
+
+That first poll reports a seeded name that is missing from the directory as deleted, once, so a listing saved before the program stopped can be used to catch files removed while it was not running. Deletes for seeded names that were never listed carry no Info or Entry.
+*/
+func (m *Monitor) Seed(names []string) {
+	m.contents = make(map[string]*entry, len(names))
+	for _, name := range names {
+		m.contents[name] = &entry{}
+	}
+	m.seeded = true
+	m.setSize(0)
+}
+
+// seedState primes the monitor from what was saved in a StateFile
+func (m *Monitor) seedState(state map[string]saved) {
+	names := make([]string, 0, len(state))
+	for name := range state {
+		names = append(names, name)
+	}
+	m.Seed(names)
+	for name, details := range state {
+		details := details
+		m.contents[name].saved = &details
+	}
+}
+
+// seedReference primes the monitor from a listing of referenceName
+func (m *Monitor) seedReference(referenceName string) error {
+	folder, err := m.read(referenceName)
+	if err != nil {
+		return err
+	}
+	m.contents = make(map[string]*entry, len(folder))
+	var size int64
+	for _, file := range folder {
+		m.contents[file.name] = &entry{info: file.info, dirent: file.dirent, hash: m.hash(referenceName, file)}
+		size += sizeOf(file.info)
+	}
+	m.seeded = true
+	m.setSize(size)
+	return nil
+}
+
+/*
+TotalSize returns the combined size of the regular files being tracked, as of the last poll. It is kept up to date as changes are found rather than recomputed, and is safe to call while Directory is running. It is always zero when SkipStat is set.
+*/
+func (m *Monitor) TotalSize() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.size
+}
+
+/*
+Healthy reports whether the Monitor has completed a poll within the last maxAge. A Monitor that is not running, or whose polls are hung on a slow filesystem or keep hitting PollTimeout, is not healthy. It is safe to call while Directory is running.
+*/
+func (m *Monitor) Healthy(maxAge time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return !m.lastPoll.IsZero() && time.Since(m.lastPoll) <= maxAge
+}
+
+/*
+Backend reports how a running Monitor finds out about changes: "inotify", "kqueue" or "ReadDirectoryChangesW" when it is woken by native change notifications, as described for PollOnly, or "poll" when it relies on polling alone. It returns "" when the Monitor is not running, and is safe to call while Directory is running.
+*/
+func (m *Monitor) Backend() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.backend
+}
+
+func (m *Monitor) polledAt(t time.Time) {
+	m.mu.Lock()
+	m.lastPoll = t
+	m.mu.Unlock()
+}
+
+func (m *Monitor) setSize(size int64) {
+	m.mu.Lock()
+	m.size = size
+	m.mu.Unlock()
+}
+
+func (m *Monitor) addSize(delta int64) {
+	if delta == 0 {
+		return
+	}
+	m.mu.Lock()
+	m.size += delta
+	m.mu.Unlock()
+}
+
+// sizeOf returns the size of info if it is a regular file
+func sizeOf(info os.FileInfo) int64 {
+	if info == nil || !info.Mode().IsRegular() {
+		return 0
+	}
+	return info.Size()
+}
+
+/*
+OnExt routes events for files with the extension ext to handler instead of the onAdd and onDelete callbacks given to Directory, which remain the fallback for every other file. Extensions are matched case-insensitively, with or without the leading dot, and an empty ext matches files that have no extension. OnExt must be called before Directory. Routing only replaces callbacks, so a Monitor started with Start still delivers every event on its channel and never calls handler.
+*/
+func (m *Monitor) OnExt(ext string, handler func(Event)) {
+	ext = strings.ToLower(ext)
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	if m.routes == nil {
+		m.routes = make(map[string]func(Event))
+	}
+	m.routes[ext] = handler
+}
+
+/*
+SetInterval changes how long the Monitor waits between polls, taking effect from the next wait. When native notifications are in use, see PollOnly, a poll also follows each notification and the interval only bounds how long the Monitor goes without polling. It is safe to call while Directory is running. Intervals that are not positive are rejected with ErrInvalidInterval.
+*/
+func (m *Monitor) SetInterval(d time.Duration) error {
+	if d <= 0 {
+		return ErrInvalidInterval
+	}
+	m.mu.Lock()
+	m.interval = d
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Monitor) currentInterval() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.interval == 0 {
+		return pollInterval
+	}
+	return m.interval
+}
+
+// nextPoll returns how long to wait before polling again, which is sooner
+// than the interval if held back changes are due before then
+func (m *Monitor) nextPoll() time.Duration {
+	d := m.currentInterval()
+	if due, ok := m.due(time.Now()); ok && due < d {
+		d = due
+	}
+	return d
+}
+
+/*
+WaitFor blocks until the file name inside directoryName is present (or absent, when present is false), returning nil once it is. The directory is checked as often as the Monitor polls. If ctx is done first, its error is returned.
+*/
+func (m *Monitor) WaitFor(ctx context.Context, directoryName string, name string, present bool) error {
+	return WaitFor(ctx, m.currentInterval(), directoryName, name, present)
+}
+
+/*
+WaitFor blocks until the file name inside directoryName is present (or absent, when present is false), checking every interval, and returns nil once it is. Intervals that are not positive are rejected with ErrInvalidInterval. Only something other than a directory counts as the file being present, so a directory appearing under that name does not satisfy a wait for the file and a file replaced by a directory counts as gone. If ctx is done first, its error is returned.
+*/
+func WaitFor(ctx context.Context, interval time.Duration, directoryName string, name string, present bool) error {
+	if interval <= 0 {
+		return ErrInvalidInterval
+	}
+	path := filepath.Join(directoryName, name)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		info, err := os.Stat(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if (err == nil && !info.IsDir()) == present {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// polled passes a summary of changes to OnPoll
+func (m *Monitor) polled(changes []Event) {
+	if m.OnPoll == nil {
+		return
+	}
+
+	var stats PollStats
+	for _, change := range ungroup(changes) {
+		var size int64
+		if info := change.stat(); info != nil && info.Mode().IsRegular() {
+			size = info.Size()
+		}
+		switch change.Op {
+		case Delete:
+			stats.Deleted++
+			stats.BytesDeleted += size
+		case Modify:
+			stats.Modified++
+			stats.BytesModified += size - sizeOf(change.prev.info)
+		case Rename:
+			stats.Renamed++
+		default:
+			stats.Added++
+			stats.BytesAdded += size
+		}
+	}
+	m.OnPoll(stats)
+}
+
+// recount passes the number of tracked entries to OnCount if it has moved
+func (m *Monitor) recount() {
+	if m.OnCount == nil || (m.counted && m.count == len(m.contents)) {
+		return
+	}
+	m.counted = true
+	m.count = len(m.contents)
+	m.OnCount(m.count)
+}
+
+// checkDir stats the watched directory, calling OnDirTouch if its
+// modification time has moved since the last check
+func (m *Monitor) checkDir(directoryName string) error {
+	if m.OnDirTouch == nil {
+		return nil
+	}
+
+	info, err := os.Stat(directoryName)
+	if err != nil {
+		return err
+	}
+
+	if m.dirInfo != nil && !info.ModTime().Equal(m.dirInfo.ModTime()) {
+		m.OnDirTouch(info)
+	}
+	m.dirInfo = info
+	return nil
+}
+
+// handleinitial delivers the initial listing, batched as the
+// InitialBatch options ask
+func (m *Monitor) handleinitial(ctx context.Context, initial []Event, deliver func(Event) error) []failure {
+	if m.InitialBatchDelay <= 0 {
+		return m.handlechanges(initial, deliver)
+	}
+
+	size := m.InitialBatchSize
+	if size <= 0 {
+		size = 1
+	}
+	var failed []failure
+	for len(initial) > 0 {
+		n := size
+		if n > len(initial) {
+			n = len(initial)
+		}
+		failed = append(failed, m.handlechanges(initial[:n], deliver)...)
+		initial = initial[n:]
+		if len(initial) > 0 && !sleep(ctx, m.InitialBatchDelay) {
+			break
+		}
+	}
+
+	//anything left undelivered is retried once monitoring resumes
+	for _, change := range initial {
+		failed = append(failed, failure{change, ctx.Err()})
+	}
+	return failed
+}
+
+// sleep waits for d, returning false if ctx is done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// noError adapts a callback that cannot fail to one that can
+func noError(callback func(string)) func(string) error {
+	if callback == nil {
+		return nil
+	}
+	return func(s string) error {
+		callback(s)
+		return nil
+	}
+}
+
+// failure is a change whose callback returned an error
+type failure struct {
+	Event
+	err error
+}
+
+// handlechanges delivers changes, returning the ones whose callbacks failed
+func (m *Monitor) handlechanges(changes []Event, deliver func(Event) error) []failure {
+	changes = m.split(changes)
+	for i := range changes {
+		changes[i].Dir = m.dir
+	}
+	changes = m.filter(changes)
+	m.number(changes)
+
+	workers := m.Concurrency
+	if workers > len(changes) {
+		workers = len(changes)
+	}
+
+	var failed []failure
+	if workers <= 1 {
+		for _, change := range changes {
+			if err := m.handlechange(change, deliver); err != nil {
+				failed = append(failed, failure{change, err})
+			}
+		}
+		m.panicked(failed)
+		m.forgetRetries(changes, failed)
+		return failed
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex //guards failed
+	jobs := make(chan Event)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for change := range jobs {
+				if err := m.handlechange(change, deliver); err != nil {
+					mu.Lock()
+					failed = append(failed, failure{change, err})
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, change := range changes {
+		jobs <- change
+	}
+	close(jobs)
+	wg.Wait()
+
+	m.panicked(failed)
+	m.forgetRetries(changes, failed)
+	return failed
+}
+
+// split turns the modifies that SplitRewrites treats as new contents into
+// a delete and an add
+func (m *Monitor) split(changes []Event) []Event {
+	if !m.SplitRewrites {
+		return changes
+	}
+	result := make([]Event, 0, len(changes))
+	for _, change := range changes {
+		if !m.rewritten(change) {
+			result = append(result, change)
+			continue
+		}
+		result = append(result,
+			Event{Name: change.Name, Op: Delete, Info: change.prev.info, Entry: change.prev.dirent, prev: change.prev},
+			Event{Name: change.Name, Op: Add, Info: change.Info, Entry: change.Entry, prev: change.prev})
+	}
+	return result
+}
+
+// rewritten reports whether change is a modify whose contents have been
+// replaced, going by SplitRewrites
+func (m *Monitor) rewritten(change Event) bool {
+	if change.Op != Modify || change.Changed&ChangedContents == 0 || change.prev == nil || change.prev.info == nil {
+		return false
+	}
+	moved := change.Info.Size() - change.prev.info.Size()
+	if moved < 0 {
+		moved = -moved
+	}
+	return moved > m.RewriteThreshold
+}
+
+// panicked reports the failures that were panics once their batch is done,
+// raising the first again if there is no OnError to report them to
+func (m *Monitor) panicked(failed []failure) {
+	for _, f := range failed {
+		if !errors.Is(f.err, ErrCallbackPanic) {
+			continue
+		}
+		if m.OnError == nil {
+			panic(f.err)
+		}
+		m.report(f.err)
+	}
+}
+
+// number gives each change the next sequence number and records it in
+// the history kept for Since
+func (m *Monitor) number(changes []Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range changes {
+		m.seq++
+		changes[i].Seq = m.seq
+	}
+	if m.History <= 0 {
+		m.history = nil
+		return
+	}
+	m.history = append(m.history, changes...)
+	if over := len(m.history) - m.History; over > 0 {
+		m.history = m.history[over:]
+	}
+}
+
+/*
+Since returns the delivered events numbered after seq, oldest first, from the last History events the Monitor has kept. The boolean is false when events after seq have already been dropped from the history, in which case the caller has missed changes and has to start again from a fresh listing. It is safe to call while Directory is running.
+*/
+func (m *Monitor) Since(seq uint64) ([]Event, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if seq >= m.seq {
+		return nil, true
+	}
+	if len(m.history) == 0 || m.history[0].Seq > seq+1 {
+		return nil, false
+	}
+	events := append([]Event(nil), m.history[seq+1-m.history[0].Seq:]...)
+	for i := range events {
+		events[i] = m.reported(events[i])
+	}
+	return events, true
+}
+
+// forgetRetries clears the retry counts of changes that did not fail
+func (m *Monitor) forgetRetries(changes []Event, failed []failure) {
+	if len(m.retries) == 0 {
+		return
+	}
+	failing := make(map[string]bool, len(failed))
+	for _, f := range failed {
+		failing[f.Name] = true
+	}
+	for _, change := range changes {
+		if !failing[change.Name] {
+			delete(m.retries, change.Name)
+		}
+	}
+}
+
+// retry rolls back what the monitor knows about failed changes so that the
+// next poll finds them again, unless they have run out of retries
+func (m *Monitor) retry(failed []failure) {
+	for _, f := range failed {
+		if m.retries == nil {
+			m.retries = make(map[string]int)
+		}
+		m.retries[f.Name]++
+		if m.MaxRetries > 0 && m.retries[f.Name] > m.MaxRetries {
+			delete(m.retries, f.Name)
+			m.report(fmt.Errorf("fsUtils: giving up on %s after %d retries: %w", f.Name, m.MaxRetries, f.err))
+			continue
+		}
+		for _, change := range ungroup([]Event{f.Event}) {
+			m.rollback(change)
+		}
+	}
+}
+
+// rollback forgets a single change so that the next poll finds it again
+func (m *Monitor) rollback(change Event) {
+	switch change.Op {
+	case Delete:
+		if value, ok := m.contents[change.Name]; ok {
+			m.addSize(-sizeOf(value.info)) //replaced, for SplitRewrites
+		}
+		value := &entry{info: change.Info, dirent: change.Entry}
+		if change.prev != nil {
+			value.hash = change.prev.hash
+		}
+		m.contents[change.Name] = value
+		m.addSize(sizeOf(change.Info))
+	case Modify:
+		//put back the old details so the change is seen again
+		if value, ok := m.contents[change.Name]; ok {
+			m.addSize(sizeOf(change.prev.info) - sizeOf(value.info))
+			value.info = change.prev.info
+			value.hash = change.prev.hash
+		}
+	case Rename:
+		if value, ok := m.contents[change.Name]; ok {
+			delete(m.contents, change.Name)
+			m.addSize(-sizeOf(value.info))
+		}
+		m.contents[change.OldName] = &entry{info: change.prev.info, dirent: change.prev.dirent, hash: change.prev.hash}
+		m.addSize(sizeOf(change.prev.info))
+	default:
+		value, ok := m.contents[change.Name]
+		if ok && change.prev != nil {
+			//the add half of a SplitRewrites pair, which was a modify
+			m.addSize(sizeOf(change.prev.info) - sizeOf(value.info))
+			value.info = change.prev.info
+			value.hash = change.prev.hash
+		} else if ok {
+			delete(m.contents, change.Name)
+			m.addSize(-sizeOf(value.info))
+		}
+	}
+}
+
+// filter returns the changes that should be delivered
+func (m *Monitor) filter(changes []Event) []Event {
+	if m.Filter == nil && len(m.IgnoreOnAdd) == 0 && len(m.IgnoreOnDelete) == 0 {
+		return changes
+	}
+	result := make([]Event, 0, len(changes))
+	for _, change := range changes {
+		var ignore []string
+		switch change.Op {
+		case Add:
+			ignore = m.IgnoreOnAdd
+		case Delete:
+			ignore = m.IgnoreOnDelete
+		}
+		if matchAny(ignore, change.Name) {
+			continue
+		}
+		if m.Filter == nil || m.Filter(m.reported(change)) {
+			result = append(result, change)
+		}
+	}
+	return result
+}
+
+// matchAny reports whether the base of name matches any of patterns
+func matchAny(patterns []string, name string) bool {
+	base := filepath.Base(name)
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// handlechange delivers a single change, turning a panic into an error
+// unless it would go unreported
+func (m *Monitor) handlechange(change Event, deliver func(Event) error) (err error) {
+	defer func() {
+		if m.OnError == nil && m.Concurrency <= 1 {
+			return //let it through, as with any other serial code
+		}
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w on %s: %v", ErrCallbackPanic, change.Name, r)
+		}
+	}()
+
+	//the change itself keeps the internal name for retries
+	ev := m.reported(change)
+	err = deliver(ev)
+	if err != nil {
+		return err
+	}
+
+	if m.OnMarker != nil && change.Op == Add {
+		if info := change.stat(); info != nil && info.Mode().IsRegular() && info.Size() == 0 {
+			m.OnMarker(ev.Name)
+		}
+	}
+	return nil
+}
+
+// reported returns ev with its names as callbacks are given them
+func (m *Monitor) reported(ev Event) Event {
+	ev.Name = m.separate(ev.Name)
+	ev.OldName = m.separate(ev.OldName)
+	return ev
+}
+
+// separate puts Separator between the elements of name
+func (m *Monitor) separate(name string) string {
+	if m.Separator == 0 || m.Separator == filepath.Separator {
+		return name
+	}
+	return strings.ReplaceAll(name, string(filepath.Separator), string(m.Separator))
+}
+
+// native undoes separate
+func (m *Monitor) native(name string) string {
+	if m.Separator == 0 || m.Separator == filepath.Separator {
+		return name
+	}
+	return strings.ReplaceAll(name, string(m.Separator), string(filepath.Separator))
+}
+
+// preflight checks that directoryName is a directory worth watching
+func (m *Monitor) preflight(directoryName string) error {
+	info, err := os.Stat(directoryName)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &os.PathError{Op: "monitor", Path: directoryName, Err: ErrNotDirectory}
+	}
+
+	if m.OnError != nil && isMountpoint(directoryName, info) {
+		dir, err := os.Open(directoryName)
+		if err != nil {
+			return err
+		}
+		names, _ := dir.Readdirnames(1)
+		dir.Close()
+		if len(names) == 0 {
+			m.report(&os.PathError{Op: "monitor", Path: directoryName, Err: ErrEmptyMount})
+		}
+	}
+	return nil
+}
+
+// save writes what is being tracked to StateFile
+func (m *Monitor) save() {
+	if m.StateFile == "" {
+		return
+	}
+	state := make(map[string]saved, len(m.contents))
+	for name, value := range m.contents {
+		switch {
+		case value.info != nil:
+			state[name] = saved{Size: value.info.Size(), ModTime: value.info.ModTime().UnixNano(), Hash: value.hash}
+		case value.saved != nil:
+			state[name] = *value.saved //not listed since it was loaded
+		default:
+			state[name] = saved{}
+		}
+	}
+	err := saveState(m.StateFile, state)
+	if err != nil {
+		m.report(err)
+	}
+}
+
+func (m *Monitor) report(err error) {
+	if m.OnError == nil {
+		return
+	}
+	m.reporting.Lock()
+	defer m.reporting.Unlock()
+	m.OnError(err)
+}
+
+// item is a single entry from a directory listing
+type item struct {
+	name   string
+	dirent os.DirEntry
+	info   os.FileInfo //nil when SkipStat is set
+}
+
+// list reads the entries being monitored under directoryName, passing
+// problems it carries on past to warn
+func (m *Monitor) list(directoryName string, warn func(error)) ([]item, error) {
+	if m.subdirs != "" {
+		return m.listSubdirs(directoryName, warn)
+	}
+	return m.listDir(directoryName, "", warn)
+}
+
+// listSubdirs reads the entries of each subdirectory of parentName that
+// matches the Subdirectories pattern
+func (m *Monitor) listSubdirs(parentName string, warn func(error)) ([]item, error) {
+	dirents, err := m.matchSubdirs(parentName)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []item
+	for _, dirent := range dirents {
+		folder, err := m.listDir(filepath.Join(parentName, dirent.Name()), dirent.Name(), warn)
+		if os.IsNotExist(err) {
+			continue //removed since it was listed
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, folder...)
+	}
+	return result, nil
+}
+
+// matchSubdirs returns the subdirectories of parentName that match the
+// Subdirectories pattern
+func (m *Monitor) matchSubdirs(parentName string) ([]os.DirEntry, error) {
+	dirents, err := os.ReadDir(parentName)
+	if err != nil {
+		return nil, err
+	}
+
+	result := dirents[:0]
+	for _, dirent := range dirents {
+		if !dirent.IsDir() {
+			continue
+		}
+		if ok, _ := filepath.Match(m.subdirs, dirent.Name()); ok {
+			result = append(result, dirent)
+		}
+	}
+	return result, nil
+}
+
+// listDir reads the entries of directoryName in name order, naming each
+// relative to prefix
+func (m *Monitor) listDir(directoryName string, prefix string, warn func(error)) ([]item, error) {
+	if m.Recursive {
+		return m.listTree(directoryName, prefix, warn)
+	}
+
+	dirents, err := os.ReadDir(directoryName)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]item, 0, len(dirents))
+	for _, dirent := range dirents {
+		file, ok, err := m.item(dirent, prefix)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			result = append(result, file)
+		}
+	}
 	return result, nil
 }
+
+// listTree reads every entry below rootName, naming each relative to
+// rootName and then prefix
+func (m *Monitor) listTree(rootName string, prefix string, warn func(error)) ([]item, error) {
+	var result []item
+	err := filepath.WalkDir(rootName, func(path string, dirent fs.DirEntry, err error) error {
+		if err != nil {
+			if path == rootName {
+				return err
+			}
+			if !os.IsNotExist(err) {
+				warn(err)
+			}
+			return fs.SkipDir //removed or unreadable since it was listed
+		}
+		if path == rootName {
+			return nil
+		}
+
+		rel, err := filepath.Rel(rootName, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		if dirent.IsDir() && m.excluded(filepath.Join(prefix, rel, dirent.Name())) {
+			return fs.SkipDir
+		}
+		file, ok, err := m.item(dirent, filepath.Join(prefix, rel))
+		if err != nil {
+			return err
+		}
+		if ok {
+			result = append(result, file)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// item turns a listed dirent into an item named relative to prefix,
+// statting it unless SkipStat is set. It returns false if the file is left
+// out by MonitorOptions or has been removed since it was listed.
+func (m *Monitor) item(dirent os.DirEntry, prefix string) (item, bool, error) {
+	file := item{name: filepath.Join(prefix, dirent.Name()), dirent: dirent}
+	if m.excluded(file.name) || (!dirent.IsDir() && len(m.Include) > 0 && !matchName(m.Include, file.name, false)) {
+		return file, false, nil
+	}
+	if !m.SkipStat {
+		info, err := dirent.Info()
+		if os.IsNotExist(err) {
+			return file, false, nil
+		}
+		if err != nil {
+			return file, false, err
+		}
+		file.info = info
+	}
+	return file, true, nil
+}
+
+// excluded reports whether name is left out by IgnoreHidden or Exclude
+func (m *Monitor) excluded(name string) bool {
+	if m.IgnoreHidden {
+		for _, element := range strings.Split(filepath.ToSlash(name), "/") {
+			if strings.HasPrefix(element, ".") {
+				return true
+			}
+		}
+	}
+	return matchName(m.Exclude, name, true)
+}
+
+// matchName reports whether name matches any of the MonitorOptions
+// patterns, trying patterns without a slash against every element of
+// name when elements is true, and otherwise against its base
+func matchName(patterns []string, name string, elements bool) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+	name = filepath.ToSlash(name)
+	parts := []string{path.Base(name)}
+	if elements {
+		parts = strings.Split(name, "/")
+	}
+	for _, pattern := range patterns {
+		if strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+			continue
+		}
+		for _, part := range parts {
+			if ok, _ := path.Match(pattern, part); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// listing is the result of a read run in the background
+type listing struct {
+	folder   []item
+	warnings []error //for the monitor's goroutine to pass to OnError
+	err      error
+}
+
+// read lists directoryName, giving up after m.PollTimeout. An abandoned
+// read is left to finish in the background, and the next read of the same
+// directory waits for it instead of starting another.
+func (m *Monitor) read(directoryName string) ([]item, error) {
+	if m.PollTimeout <= 0 {
+		return m.list(directoryName, m.report)
+	}
+
+	done := m.reading
+	if done == nil || m.readingDir != directoryName {
+		done = make(chan listing, 1)
+		go func() {
+			var l listing
+			l.folder, l.err = m.list(directoryName, func(err error) {
+				l.warnings = append(l.warnings, err)
+			})
+			done <- l
+		}()
+		m.reading = done
+		m.readingDir = directoryName
+	}
+
+	timer := time.NewTimer(m.PollTimeout)
+	defer timer.Stop()
+	select {
+	case l := <-done:
+		m.reading = nil
+		for _, err := range l.warnings {
+			m.report(err)
+		}
+		return l.folder, l.err
+	case <-timer.C:
+		return nil, &os.PathError{Op: "readdir", Path: directoryName, Err: ErrPollTimeout}
+	}
+}
+
+func (m *Monitor) buildContents(directoryName string) error {
+	folder, err := m.read(directoryName)
+
+	if err != nil {
+		return err
+	}
+
+	m.contents = make(map[string]*entry)
+	var size int64
+	for _, file := range folder {
+		if m.active(file) {
+			continue
+		}
+		m.contents[file.name] = &entry{info: file.info, dirent: file.dirent, hash: m.hash(directoryName, file)}
+		size += sizeOf(file.info)
+	}
+	m.setSize(size)
+	return nil
+}
+
+// active reports whether file was written too recently to be reported
+func (m *Monitor) active(file item) bool {
+	if m.SkipActive <= 0 {
+		return false
+	}
+	info := file.info
+	if info == nil {
+		var err error
+		info, err = file.dirent.Info()
+		if err != nil {
+			return true //look again next poll
+		}
+	}
+	return time.Since(info.ModTime()) < m.SkipActive
+}
+
+func (m *Monitor) contentArray() []Event {
+	result := make([]Event, len(m.contents))
+	for i, key := range m.names() {
+		value := m.contents[key]
+		result[i] = Event{Name: key, Op: Add, Info: value.info, Entry: value.dirent}
+	}
+	return result
+}
+
+// names returns the names being tracked in sorted order
+func (m *Monitor) names() []string {
+	result := make([]string, 0, len(m.contents))
+	for key := range m.contents {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (m *Monitor) getDiff(directoryName string) ([]Event, error) {
+	if m.StreamChunk > 0 && m.subdirs == "" && !m.Recursive {
+		return m.streamDiff(directoryName)
+	}
+
+	folder, err := m.read(directoryName)
+	if err != nil {
+		return nil, err
+	}
+
+	d := diff{count: len(folder)}
+	for _, file := range folder {
+		m.see(&d, file)
+	}
+	return m.commit(&d, directoryName), nil
+}
+
+// streamDiff is getDiff for StreamChunk, diffing the directory a chunk
+// at a time as it is read instead of reading the whole listing first
+func (m *Monitor) streamDiff(directoryName string) ([]Event, error) {
+	dir, err := os.Open(directoryName)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	var deadline time.Time
+	if m.PollTimeout > 0 {
+		deadline = time.Now().Add(m.PollTimeout)
+	}
+
+	var d diff
+	for {
+		dirents, err := dir.ReadDir(m.StreamChunk)
+		for _, dirent := range dirents {
+			file, ok, ierr := m.item(dirent, "")
+			if ierr != nil {
+				m.abandon()
+				return nil, ierr
+			}
+			if ok {
+				d.count++
+				m.see(&d, file)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			m.abandon()
+			return nil, err
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			m.abandon()
+			return nil, &os.PathError{Op: "readdir", Path: directoryName, Err: ErrPollTimeout}
+		}
+	}
+	return m.commit(&d, directoryName), nil
+}
+
+// diff accumulates what a poll has found until it is committed
+type diff struct {
+	count   int       //entries listed
+	added   []item    //entries not being tracked yet
+	updated []refresh //tracked entries whose details have changed
+	stable  []refresh //tracked entries that have stopped growing
+}
+
+// refresh pairs a tracked entry with its latest listing
+type refresh struct {
+	value *entry
+	file  item
+}
+
+// see checks a listed entry against what is being tracked. Apart from
+// marking the entry seen, nothing changes until the diff is committed.
+func (m *Monitor) see(d *diff, file item) {
+	value, ok := m.contents[file.name]
+	if !ok {
+		if !m.active(file) {
+			d.added = append(d.added, file)
+		}
+		return
+	}
+
+	value.seen = true
+	value.dirent = file.dirent
+	if file.info == nil || (value.info != nil && m.active(file)) {
+		return //still being written, so compared again next poll
+	}
+	if value.info == nil || file.info.Size() != value.info.Size() ||
+		file.info.Mode() != value.info.Mode() || !file.info.ModTime().Equal(value.info.ModTime()) ||
+		m.changes(value.info, file.info) != 0 {
+		d.updated = append(d.updated, refresh{value, file})
+	} else if value.growing {
+		d.stable = append(d.stable, refresh{value, file})
+	}
+}
+
+// changes returns which of the details the monitor watches differ between
+// two FileInfos for the same tracked name
+func (m *Monitor) changes(prev os.FileInfo, info os.FileInfo) Changes {
+	var c Changes
+	if info.Mode().Type() != prev.Mode().Type() {
+		c |= ChangedType
+	}
+	if m.WatchMode && info.Mode()&^os.ModeType != prev.Mode()&^os.ModeType {
+		c |= ChangedMode
+	}
+	if !info.IsDir() { //a directory's size and time follow its contents
+		if info.Size() != prev.Size() {
+			c |= ChangedSize
+		}
+		if !info.ModTime().Equal(prev.ModTime()) {
+			c |= ChangedModTime
+		}
+		if m.WatchLinks {
+			before, ok := linkCount(prev)
+			after, _ := linkCount(info)
+			if ok && before != after {
+				c |= ChangedLinks
+			}
+		}
+	}
+	if m.WatchOwnership {
+		uid, gid, ok := owner(prev)
+		nowUID, nowGID, _ := owner(info)
+		if ok && (uid != nowUID || gid != nowGID) {
+			c |= ChangedOwner
+		}
+	}
+	return c
+}
+
+// abandon drops a poll that could not finish
+func (m *Monitor) abandon() {
+	for _, value := range m.contents {
+		value.seen = false
+	}
+}
+
+// commit applies a diff to what is being tracked, returning the changes
+func (m *Monitor) commit(d *diff, directoryName string) []Event {
+	m.stable = m.stable[:0]
+
+	//Hold off on a suspicious empty listing until it has been confirmed
+	if d.count == 0 && len(m.contents) > 0 && m.EmptyPolls > 0 {
+		m.empties++
+		if m.empties < m.EmptyPolls {
+			return nil
+		}
+	}
+	m.empties = 0
+
+	result := make([]Event, 0, len(d.added))
+	var modified []Event
+	var delta int64 //change to the total size
+
+	//Refresh the details of files that were already tracked
+	for _, r := range d.updated {
+		prev := *r.value
+		delta += sizeOf(r.file.info) - sizeOf(prev.info)
+		switch {
+		case !r.file.info.Mode().IsRegular():
+			r.value.growing = false
+		case prev.info != nil && prev.info.Mode().IsRegular() && r.file.info.Size() != prev.info.Size():
+			r.value.growing = true
+		}
+		r.value.info = r.file.info
+		if prev.info == nil {
+			s := prev.saved
+			if m.HashContents && s != nil && s.Hash != "" && s.Size == r.file.info.Size() && s.ModTime == r.file.info.ModTime().UnixNano() {
+				r.value.hash = s.Hash //unchanged since it was saved
+			} else {
+				r.value.hash = m.hash(directoryName, r.file)
+			}
+			r.value.saved = nil
+			continue
+		}
+		changed := m.changes(prev.info, r.file.info)
+		if changed&(ChangedSize|ChangedModTime|ChangedType) != 0 {
+			r.value.hash = m.hash(directoryName, r.file)
+			if r.value.hash != "" && r.value.hash == prev.hash {
+				changed &^= ChangedModTime //touched but not rewritten
+			} else if r.value.hash != "" && prev.hash != "" {
+				changed |= ChangedContents
+			}
+		}
+		if changed == 0 {
+			continue
+		}
+		modified = append(modified, Event{Name: r.file.name, Op: Modify, Info: r.file.info, Entry: r.file.dirent, Changed: changed, prev: &prev})
+	}
+	for _, r := range d.stable {
+		r.value.growing = false
+		m.stable = append(m.stable, Event{Name: r.file.name, Op: Add, Info: r.file.info, Entry: r.file.dirent})
+	}
+
+	//Start tracking new files
+	for _, file := range d.added {
+		m.contents[file.name] = &entry{info: file.info, dirent: file.dirent, hash: m.hash(directoryName, file), seen: true}
+		delta += sizeOf(file.info)
+		result = append(result, Event{Name: file.name, Op: Add, Info: file.info, Entry: file.dirent})
+	}
+
+	//Check if files have been removed
+	var deleted []Event
+	for _, key := range m.names() {
+		if value := m.contents[key]; !value.seen {
+			delete(m.contents, key)
+			delta -= sizeOf(value.info)
+			deleted = append(deleted, Event{Name: key, Op: Delete, Info: value.info, Entry: value.dirent, prev: value})
+		}
+	}
+
+	if m.DetectRenames && len(result) > 0 && len(deleted) > 0 {
+		deleted = m.renames(result, deleted)
+	}
+	result = append(result, modified...)
+	result = append(result, deleted...)
+
+	//Set files back to unseen
+	for _, value := range m.contents {
+		value.seen = false
+	}
+
+	m.addSize(delta)
+
+	return m.group(result)
+}
+
+// group replaces changes with an event for each directory they were in,
+// for GranularityDirectory. Renames are split into a delete and an add,
+// since the two names may be in different directories.
+func (m *Monitor) group(changes []Event) []Event {
+	if m.Granularity != GranularityDirectory || len(changes) == 0 {
+		return changes
+	}
+
+	dirs := make(map[string]*Event)
+	add := func(change Event) {
+		dir := filepath.Dir(change.Name)
+		for dir != "." && m.contents[dir] == nil {
+			dir = filepath.Dir(dir) //gone along with the change
+		}
+		ev, ok := dirs[dir]
+		if !ok {
+			ev = &Event{Name: dir, Op: Modify}
+			if value := m.contents[dir]; value != nil {
+				ev.Info, ev.Entry = value.info, value.dirent
+			}
+			dirs[dir] = ev
+		}
+		ev.grouped = append(ev.grouped, change)
+	}
+	for _, change := range changes {
+		if change.Op == Rename {
+			add(Event{Name: change.OldName, Op: Delete, Info: change.prev.info, Entry: change.prev.dirent, prev: change.prev})
+			change = Event{Name: change.Name, Op: Add, Info: change.Info, Entry: change.Entry}
+		}
+		add(change)
+	}
+
+	result := make([]Event, 0, len(dirs))
+	for _, ev := range dirs {
+		result = append(result, *ev)
+	}
+	less := m.OrderDirs
+	if less == nil {
+		less = func(a, b string) bool { return a < b }
+	}
+	sort.Slice(result, func(i, j int) bool { return less(result[i].Name, result[j].Name) })
+	return result
+}
+
+/*
+ByDepth orders directory names for OrderDirs by how deep they are, so the watched directory comes first and every directory comes before those inside it. Directories that are as deep as each other are ordered by name.
+*/
+func ByDepth(a, b string) bool {
+	da, db := depth(a), depth(b)
+	if da != db {
+		return da < db
+	}
+	return a < b
+}
+
+// depth returns how many directories name is below the watched one, with
+// the watched directory itself, ".", at -1
+func depth(name string) int {
+	if name == "." {
+		return -1
+	}
+	return strings.Count(name, string(filepath.Separator))
+}
+
+// ungroup returns changes with GranularityDirectory events replaced by the
+// changes they stand for
+func ungroup(changes []Event) []Event {
+	result := make([]Event, 0, len(changes))
+	for _, change := range changes {
+		if change.grouped != nil {
+			result = append(result, change.grouped...)
+		} else {
+			result = append(result, change)
+		}
+	}
+	return result
+}
+
+// identity is what a file keeps across a rename
+type identity struct {
+	dev, ino uint64
+	dir      bool
+	size     int64
+	modTime  int64
+	hash     string
+}
+
+// identify returns the identity of a tracked file, which is false if the
+// file has never been statted
+func identify(value *entry) (identity, bool) {
+	if value == nil || value.info == nil {
+		return identity{}, false
+	}
+	id := identity{dir: value.info.IsDir()}
+	var ok bool
+	id.dev, id.ino, ok = fileID(value.info)
+	if ok && id.dir {
+		return id, true //a directory moved elsewhere may have its times updated
+	}
+	id.size = value.info.Size()
+	id.modTime = value.info.ModTime().UnixNano()
+	if !ok {
+		id.hash = value.hash
+	}
+	return id, true
+}
+
+// renames turns adds that match a deleted file into renames of it,
+// returning the deletes that were not matched
+func (m *Monitor) renames(added []Event, deleted []Event) []Event {
+	gone := make(map[identity][]int, len(deleted))
+	for i, ev := range deleted {
+		if id, ok := identify(ev.prev); ok {
+			gone[id] = append(gone[id], i)
+		}
+	}
+	arrived := make(map[identity]int, len(added))
+	for _, ev := range added {
+		if id, ok := identify(m.contents[ev.Name]); ok {
+			arrived[id]++
+		}
+	}
+
+	paired := make(map[int]bool)
+	for i, ev := range added {
+		id, ok := identify(m.contents[ev.Name])
+		if !ok || len(gone[id]) != 1 || arrived[id] != 1 {
+			continue //no match, or more than one to choose from
+		}
+		old := deleted[gone[id][0]]
+		added[i].Op = Rename
+		added[i].OldName = old.Name
+		added[i].prev = old.prev
+		paired[gone[id][0]] = true
+	}
+	if len(paired) == 0 {
+		return deleted
+	}
+
+	result := deleted[:0]
+	for i, ev := range deleted {
+		if !paired[i] {
+			result = append(result, ev)
+		}
+	}
+	return result
+}
+
+// hash returns the SHA-256 of a regular file's contents when HashContents
+// is set, or "" if the file cannot be read
+func (m *Monitor) hash(directoryName string, file item) string {
+	if !m.HashContents || file.info == nil || !file.info.Mode().IsRegular() {
+		return ""
+	}
+
+	f, err := os.Open(filepath.Join(directoryName, file.name))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			m.report(err)
+		}
+		return ""
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		m.report(err)
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
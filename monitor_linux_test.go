@@ -0,0 +1,63 @@
+//go:build linux
+
+package fsUtils
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestExcludePrunes(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "src/main.go", "")
+	for i := 0; i < 500; i++ {
+		write(t, dir, fmt.Sprintf("node_modules/pkg%03d/index.js", i), "")
+	}
+
+	//a chain of directories too deep to name in full fails any walk that
+	//reaches it, which shows whether the monitor went in
+	fd, err := syscall.Open(filepath.Join(dir, "node_modules"), syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := strings.Repeat("d", 250)
+	for i := 0; i < 20; i++ {
+		if err := syscall.Mkdirat(fd, name, 0755); err != nil {
+			t.Fatal(err)
+		}
+		next, err := syscall.Openat(fd, name, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+		syscall.Close(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd = next
+	}
+	syscall.Close(fd)
+
+	var warnings []error
+	warn := func(err error) { warnings = append(warnings, err) }
+	m := &Monitor{Recursive: true}
+	if _, err := m.list(dir, warn); err == nil && len(warnings) == 0 {
+		t.Fatal("walking the deep chain did not fail, so it proves nothing")
+	}
+
+	m = &Monitor{Recursive: true}
+	m.Exclude = []string{"node_modules"}
+	folder, err := m.list(dir, warn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 0 {
+		t.Fatalf("got warnings %v from an excluded directory", warnings)
+	}
+	var names []string
+	for _, file := range folder {
+		names = append(names, file.name)
+	}
+	if len(names) != 2 || names[0] != "src" || names[1] != filepath.Join("src", "main.go") {
+		t.Fatalf("got %v", names)
+	}
+}
@@ -0,0 +1,1341 @@
+package fsUtils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// start runs m over dir in the background, polling quickly, and stops it
+// when the test ends
+func start(t *testing.T, m *Monitor, dir string) <-chan Event {
+	t.Helper()
+	if err := m.SetInterval(20 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(dir); err != nil {
+		t.Fatal(err)
+	}
+	events := m.Events()
+	t.Cleanup(func() { m.Stop() })
+	return events
+}
+
+// next returns the next event, failing the test if none arrives in time
+func next(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatal("events closed")
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return Event{}
+}
+
+// silent fails the test if an event arrives within d
+func silent(t *testing.T, events <-chan Event, d time.Duration) {
+	t.Helper()
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event %+v", ev)
+	case <-time.After(d):
+	}
+}
+
+// write creates the file name below dir holding data
+func write(t *testing.T, dir string, name string, data string) {
+	t.Helper()
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expect fails the test unless ev is op on name
+func expect(t *testing.T, ev Event, op Op, name string) {
+	t.Helper()
+	if ev.Op != op || ev.Name != name {
+		t.Fatalf("got %v on %q, want %v on %q", ev.Op, ev.Name, op, name)
+	}
+}
+
+func TestSeparator(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "sub/x", "")
+
+	//a backslash stands in for Windows, where the native separator is one
+	m := &Monitor{Recursive: true, Separator: '\\'}
+	events := start(t, m, dir)
+	expect(t, next(t, events), Add, "sub")
+	expect(t, next(t, events), Add, `sub\x`)
+
+	write(t, dir, "sub/y", "")
+	expect(t, next(t, events), Add, `sub\y`)
+
+	if err := os.Remove(filepath.Join(dir, "sub", "x")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, next(t, events), Delete, `sub\x`)
+}
+
+func TestMerge(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir()}
+	var monitors []*Monitor
+	for _, dir := range dirs {
+		m := &Monitor{}
+		if err := m.SetInterval(20 * time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Start(dir); err != nil {
+			t.Fatal(err)
+		}
+		monitors = append(monitors, m)
+	}
+	events, stop := Merge(monitors...)
+	defer stop()
+
+	write(t, dirs[0], "a", "")
+	ev := next(t, events)
+	if ev.Dir != dirs[0] {
+		t.Fatalf("got Dir %q, want %q", ev.Dir, dirs[0])
+	}
+	expect(t, ev, Add, "a")
+
+	write(t, dirs[1], "b", "")
+	ev = next(t, events)
+	if ev.Dir != dirs[1] {
+		t.Fatalf("got Dir %q, want %q", ev.Dir, dirs[1])
+	}
+	expect(t, ev, Add, "b")
+
+	stop()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("event after stop")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("merged channel not closed after stop")
+	}
+}
+
+func TestMergeUnstarted(t *testing.T) {
+	dir := t.TempDir()
+	started := &Monitor{}
+	start(t, started, dir)
+	events, stop := Merge(started, &Monitor{})
+	defer stop()
+
+	write(t, dir, "a", "")
+	expect(t, next(t, events), Add, "a")
+	stop()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("event after stop")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("merged channel not closed after stop")
+	}
+
+	//with nothing running there is nothing to wait for
+	events, stop = Merge(&Monitor{}, started)
+	defer stop()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("event from a monitor that is not running")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("merged channel of unstarted monitors not closed")
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	if err := WaitFor(ctx, 0, dir, "x", true); !errors.Is(err, ErrInvalidInterval) {
+		t.Fatalf("got %v, want ErrInvalidInterval", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		os.WriteFile(filepath.Join(dir, "x"), nil, 0644)
+	}()
+	if err := WaitFor(ctx, 10*time.Millisecond, dir, "x", true); err != nil {
+		t.Fatal(err)
+	}
+
+	//a directory does not count as the file being present
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := WaitFor(short, 10*time.Millisecond, dir, "d", true); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v waiting for a directory, want a timeout", err)
+	}
+	if err := WaitFor(ctx, 10*time.Millisecond, dir, "d", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	now := time.Now()
+	m := &Monitor{Coalesce: time.Second}
+	a := Event{Name: "a", Op: Add}
+	b := Event{Name: "b", Op: Add}
+	old := &entry{}
+
+	//nothing comes out until the window closes
+	if got := m.coalesce([]Event{a, b}, now); got != nil {
+		t.Fatalf("got %v before the window closed", got)
+	}
+	got := m.coalesce([]Event{
+		{Name: "a", Op: Modify, prev: &entry{}},
+		{Name: "b", Op: Delete},
+		{Name: "c", Op: Delete, prev: old},
+		{Name: "c", Op: Add},
+		{Name: "d", Op: Modify, prev: old},
+		{Name: "d", Op: Modify, prev: &entry{}},
+	}, now.Add(time.Second))
+
+	want := []struct {
+		name string
+		op   Op
+	}{
+		{"a", Add},    //added then modified
+		{"c", Modify}, //deleted then added again
+		{"d", Modify}, //modified twice
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d changes, want %d: %+v", len(got), len(want), got)
+	}
+	for i, w := range want {
+		expect(t, got[i], w.op, w.name)
+	}
+	if got[1].prev != old || got[2].prev != old {
+		t.Error("merged modifies should roll back to what was tracked before the window")
+	}
+
+	//renames are split so each name is merged on its own
+	got = m.coalesce([]Event{{Name: "new", OldName: "e", Op: Rename, prev: old}}, now.Add(2*time.Second))
+	if got != nil {
+		t.Fatalf("got %v from a new window", got)
+	}
+	got = m.coalesce(nil, now.Add(3*time.Second))
+	if len(got) != 2 {
+		t.Fatalf("got %+v, want a delete and an add", got)
+	}
+	expect(t, got[0], Delete, "e")
+	expect(t, got[1], Add, "new")
+}
+
+func TestModifyChanges(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "a", "one")
+	m := &Monitor{HashContents: true}
+	events := start(t, m, dir)
+	expect(t, next(t, events), Add, "a")
+
+	path := filepath.Join(dir, "a")
+	later := time.Now().Add(time.Hour)
+	replace(t, path, "three", later)
+	ev := next(t, events)
+	expect(t, ev, Modify, "a")
+	if ev.Changed != ChangedSize|ChangedModTime|ChangedContents {
+		t.Fatalf("got Changed %b after a rewrite", ev.Changed)
+	}
+
+	//touching without rewriting is not a modify with HashContents
+	later = later.Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	silent(t, events, 200*time.Millisecond)
+
+	later = later.Add(time.Hour)
+	replace(t, path, "THREE", later)
+	ev = next(t, events)
+	expect(t, ev, Modify, "a")
+	if ev.Changed != ChangedModTime|ChangedContents {
+		t.Fatalf("got Changed %b after a same size rewrite", ev.Changed)
+	}
+}
+
+// replace swaps the file at path for one holding data and modified at
+// mtime in a single step, so that no poll sees it half written
+func replace(t *testing.T, path string, data string, mtime time.Time) {
+	t.Helper()
+	tmp := filepath.Join(t.TempDir(), "new")
+	if err := os.WriteFile(tmp, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(tmp, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModifyType(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "x", "")
+	m := &Monitor{WatchMode: true}
+	events := start(t, m, dir)
+	expect(t, next(t, events), Add, "x")
+
+	path := filepath.Join(dir, "x")
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	ev := next(t, events)
+	expect(t, ev, Modify, "x")
+	if ev.Changed&ChangedType == 0 {
+		t.Fatalf("got Changed %b when a file became a directory", ev.Changed)
+	}
+
+	//directories are reported when only their permissions change
+	if err := os.Chmod(path, 0700); err != nil {
+		t.Fatal(err)
+	}
+	ev = next(t, events)
+	expect(t, ev, Modify, "x")
+	if ev.Changed != ChangedMode {
+		t.Fatalf("got Changed %b after a chmod", ev.Changed)
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	dir := t.TempDir()
+	m := &Monitor{}
+	if err := m.SetInterval(20 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("started on a missing directory")
+	}
+	if err := m.Start(dir); err != nil {
+		t.Fatal(err)
+	}
+	events := m.Events()
+	if err := m.Start(dir); !errors.Is(err, ErrRunning) {
+		t.Fatalf("got %v starting twice, want ErrRunning", err)
+	}
+
+	write(t, dir, "a", "")
+	expect(t, next(t, events), Add, "a")
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-events; ok {
+		t.Fatal("events still open after Stop")
+	}
+	if err := m.Stop(); err != nil {
+		t.Fatalf("got %v stopping twice", err)
+	}
+
+	//a restarted monitor lists the directory afresh
+	if err := m.Start(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	events = m.Events()
+	expect(t, next(t, events), Add, "a")
+	write(t, dir, "b", "")
+	expect(t, next(t, events), Add, "b")
+}
+
+func TestStateFile(t *testing.T) {
+	dir := t.TempDir()
+	state := filepath.Join(t.TempDir(), "state")
+	write(t, dir, "a", "")
+	write(t, dir, "b", "")
+
+	m := &Monitor{StateFile: state}
+	events := start(t, m, dir)
+	expect(t, next(t, events), Add, "a")
+	expect(t, next(t, events), Add, "b")
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	//a is deleted while nothing is watching
+	if err := os.Remove(filepath.Join(dir, "a")); err != nil {
+		t.Fatal(err)
+	}
+	m = &Monitor{StateFile: state}
+	events = start(t, m, dir)
+	expect(t, next(t, events), Delete, "a")
+	silent(t, events, 200*time.Millisecond)
+}
+
+func TestIgnoreOnOp(t *testing.T) {
+	dir := t.TempDir()
+	m := &Monitor{IgnoreOnAdd: []string{"*.tmp"}, IgnoreOnDelete: []string{"*.log"}}
+	events := start(t, m, dir)
+
+	write(t, dir, "x.tmp", "")
+	write(t, dir, "x.log", "")
+	expect(t, next(t, events), Add, "x.log")
+
+	for _, name := range []string{"x.log", "x.tmp"} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect(t, next(t, events), Delete, "x.tmp")
+	silent(t, events, 200*time.Millisecond)
+}
+
+func TestRecursive(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "a/b", "")
+	m := &Monitor{Recursive: true}
+	events := start(t, m, dir)
+	expect(t, next(t, events), Add, "a")
+	expect(t, next(t, events), Add, "a/b")
+
+	//new subdirectories are picked up and watched as well
+	write(t, dir, "a/c/d", "")
+	expect(t, next(t, events), Add, "a/c")
+	expect(t, next(t, events), Add, "a/c/d")
+	write(t, dir, "a/c/e", "")
+	expect(t, next(t, events), Add, "a/c/e")
+
+	if err := os.RemoveAll(filepath.Join(dir, "a", "c")); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		ev := next(t, events)
+		if ev.Op != Delete {
+			t.Fatalf("got %v on %q, want a delete", ev.Op, ev.Name)
+		}
+		got[ev.Name] = true
+	}
+	for _, name := range []string{"a/c", "a/c/d", "a/c/e"} {
+		if !got[name] {
+			t.Errorf("no delete for %q", name)
+		}
+	}
+}
+
+func TestDetectRenames(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "a", "contents")
+	m := &Monitor{DetectRenames: true}
+	events := start(t, m, dir)
+	expect(t, next(t, events), Add, "a")
+
+	if err := os.Rename(filepath.Join(dir, "a"), filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	ev := next(t, events)
+	expect(t, ev, Rename, "b")
+	if ev.OldName != "a" {
+		t.Fatalf("got OldName %q, want a", ev.OldName)
+	}
+
+	//without DetectRenames the same move is a delete and an add
+	m2 := &Monitor{}
+	events = start(t, m2, dir)
+	expect(t, next(t, events), Add, "b")
+	if err := os.Rename(filepath.Join(dir, "b"), filepath.Join(dir, "c")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, next(t, events), Add, "c")
+	expect(t, next(t, events), Delete, "b")
+}
+
+func TestCrossDirectoryRename(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "staging/x", "contents")
+	write(t, dir, "processed/y", "")
+	write(t, dir, "other/z", "")
+
+	//as set by Subdirectories, which does not return until monitoring ends
+	m := &Monitor{DetectRenames: true}
+	m.subdirs = "[ps]*"
+	events := start(t, m, dir)
+	expect(t, next(t, events), Add, "processed/y")
+	expect(t, next(t, events), Add, "staging/x")
+
+	if err := os.Rename(filepath.Join(dir, "staging", "x"), filepath.Join(dir, "processed", "x")); err != nil {
+		t.Fatal(err)
+	}
+	ev := next(t, events)
+	expect(t, ev, Rename, "processed/x")
+	if ev.OldName != "staging/x" {
+		t.Fatalf("got OldName %q, want staging/x", ev.OldName)
+	}
+	silent(t, events, 200*time.Millisecond)
+}
+
+func TestBackend(t *testing.T) {
+	for _, pollOnly := range []bool{false, true} {
+		changes := make(chan string, 10)
+		m := &Monitor{PollOnly: pollOnly, OnBackendChange: func(backend string) { changes <- backend }}
+		if got := m.Backend(); got != "" {
+			t.Fatalf("got backend %q before Start", got)
+		}
+		start(t, m, t.TempDir())
+
+		var got string
+		select {
+		case got = <-changes:
+		case <-time.After(5 * time.Second):
+			t.Fatal("OnBackendChange not called")
+		}
+		if got == "" || (pollOnly && got != "poll") {
+			t.Fatalf("got backend %q with PollOnly %v", got, pollOnly)
+		}
+		if now := m.Backend(); now != got {
+			t.Fatalf("Backend returned %q after OnBackendChange was given %q", now, got)
+		}
+		if err := m.Stop(); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Backend(); got != "" {
+			t.Fatalf("got backend %q after Stop", got)
+		}
+		if len(changes) != 0 {
+			t.Fatalf("OnBackendChange called again with %q", <-changes)
+		}
+	}
+}
+
+func TestCallbackPanic(t *testing.T) {
+	for _, workers := range []int{0, 2} {
+		dir := t.TempDir()
+		write(t, dir, "bad", "")
+		write(t, dir, "good", "")
+
+		errs := make(chan error, 10)
+		delivered := make(chan string, 10)
+		m := &Monitor{Concurrency: workers, MaxRetries: 1, OnError: func(err error) { errs <- err }}
+		if err := m.SetInterval(20 * time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- m.run(ctx, dir, func(ev Event) error {
+				if ev.Name == "bad" {
+					panic("boom")
+				}
+				delivered <- ev.Name
+				return nil
+			})
+		}()
+
+		select {
+		case err := <-errs:
+			if !errors.Is(err, ErrCallbackPanic) {
+				t.Fatalf("got %v, want ErrCallbackPanic", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no error for a panic with Concurrency %d", workers)
+		}
+		select {
+		case name := <-delivered:
+			if name != "good" {
+				t.Fatalf("got %q delivered", name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("a panic stopped other changes with Concurrency %d", workers)
+		}
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v once stopped", err)
+		}
+	}
+}
+
+func TestGranularityDirectory(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "a/x", "")
+	write(t, dir, "top", "")
+	m := &Monitor{Recursive: true, Granularity: GranularityDirectory}
+	events := start(t, m, dir)
+	expect(t, next(t, events), Modify, ".")
+	expect(t, next(t, events), Modify, "a")
+
+	//a bulk drop arrives as one event for the directory it landed in
+	staging := t.TempDir()
+	for i := 0; i < 100; i++ {
+		write(t, staging, fmt.Sprintf("bulk/%03d", i), "")
+	}
+	if err := os.Rename(filepath.Join(staging, "bulk"), filepath.Join(dir, "a", "bulk")); err != nil {
+		t.Fatal(err)
+	}
+	ev := next(t, events)
+	expect(t, ev, Modify, "a")
+	if ev.Info == nil || !ev.Info.IsDir() {
+		t.Fatalf("got Info %v for a directory event", ev.Info)
+	}
+	expect(t, next(t, events), Modify, filepath.Join("a", "bulk"))
+	silent(t, events, 200*time.Millisecond)
+
+	//removing a directory is reported against the one that held it
+	if err := os.RemoveAll(filepath.Join(dir, "a")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, next(t, events), Modify, ".")
+	silent(t, events, 200*time.Millisecond)
+}
+
+func TestOrderDirs(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "top", "")
+	write(t, dir, "a/b/c/x", "")
+	write(t, dir, "b/y", "")
+	m := &Monitor{Recursive: true, Granularity: GranularityDirectory, OrderDirs: ByDepth}
+	events := start(t, m, dir)
+	for _, name := range []string{".", "a", "b", filepath.Join("a", "b"), filepath.Join("a", "b", "c")} {
+		expect(t, next(t, events), Modify, name)
+	}
+
+	if !ByDepth(".", "-a") || ByDepth("-a", ".") {
+		t.Fatal("the watched directory does not come first")
+	}
+	if !ByDepth("a", "b") || ByDepth("b", "a") {
+		t.Fatal("directories as deep as each other are not ordered by name")
+	}
+}
+
+func TestStateFileHashes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(t.TempDir(), "state")
+	write(t, dir, "a", "one")
+	write(t, dir, "b", "two")
+	write(t, dir, "c", "three")
+
+	m := &Monitor{StateFile: path, HashContents: true}
+	events := start(t, m, dir)
+	for _, name := range []string{"a", "b", "c"} {
+		expect(t, next(t, events), Add, name)
+	}
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state) != 3 || state["a"].Hash == "" {
+		t.Fatalf("got state %+v", state)
+	}
+
+	//a saved hash is trusted while the size and time match, so a made up
+	//one shows whether a was read again
+	a := state["a"]
+	a.Hash = "saved"
+	state["a"] = a
+	if err := saveState(path, state); err != nil {
+		t.Fatal(err)
+	}
+	write(t, dir, "b", "TWO")
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "b"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "c")); err != nil {
+		t.Fatal(err)
+	}
+
+	m = &Monitor{StateFile: path, HashContents: true}
+	events = start(t, m, dir)
+	expect(t, next(t, events), Delete, "c")
+	silent(t, events, 200*time.Millisecond)
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.contents["a"].hash; got != "saved" {
+		t.Errorf("a was hashed again, got %q", got)
+	}
+	if got := m.contents["b"].hash; got == "" || got == state["b"].Hash {
+		t.Errorf("b was not hashed again after changing, got %q", got)
+	}
+
+	state, err = loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state["c"]; ok || len(state) != 2 {
+		t.Fatalf("got state %+v, want c dropped", state)
+	}
+
+	//files from before details were saved hold just the names
+	if err := os.WriteFile(path, []byte(`["a"]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	state, err = loadState(path)
+	if _, ok := state["a"]; err != nil || !ok || len(state) != 1 {
+		t.Fatalf("got %+v, %v loading a list of names", state, err)
+	}
+}
+
+func TestSplitRewrites(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "a", "0123456789")
+	m := &Monitor{HashContents: true, SplitRewrites: true, RewriteThreshold: 4}
+	events := start(t, m, dir)
+	expect(t, next(t, events), Add, "a")
+
+	//a small change in size is still an edit
+	path := filepath.Join(dir, "a")
+	replace(t, path, "0123456789x", time.Now())
+	expect(t, next(t, events), Modify, "a")
+
+	replace(t, path, "short", time.Now())
+	expect(t, next(t, events), Delete, "a")
+	ev := next(t, events)
+	expect(t, ev, Add, "a")
+	if ev.Info == nil || ev.Info.Size() != 5 {
+		t.Fatalf("got Info %v for the new contents", ev.Info)
+	}
+	silent(t, events, 100*time.Millisecond)
+	if got := m.TotalSize(); got != 5 {
+		t.Fatalf("got TotalSize %d, want 5", got)
+	}
+}
+
+func TestOnStable(t *testing.T) {
+	dir := t.TempDir()
+	stable := make(chan string, 10)
+	m := &Monitor{OnStable: func(name string, info os.FileInfo) { stable <- name }}
+	events := start(t, m, dir)
+
+	//entries that never grow are not reported
+	write(t, dir, "done", "complete")
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	linked := os.Symlink("done", filepath.Join(dir, "l")) == nil
+	write(t, dir, "up", "a")
+	want := 3
+	if linked {
+		want++
+	}
+	for i := 0; i < want; i++ {
+		if ev := next(t, events); ev.Op != Add {
+			t.Fatalf("got %v on %q, want an add", ev.Op, ev.Name)
+		}
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, "up"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("bc"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	expect(t, next(t, events), Modify, "up")
+
+	select {
+	case name := <-stable:
+		if name != "up" {
+			t.Fatalf("got OnStable for %q, want up", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnStable not called once up stopped growing")
+	}
+	silent(t, events, 200*time.Millisecond)
+	if len(stable) != 0 {
+		t.Fatalf("OnStable called again for %q", <-stable)
+	}
+}
+
+func TestStopPending(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "a", "")
+	m := &Monitor{StateFile: filepath.Join(t.TempDir(), "state")}
+	events := start(t, m, dir)
+	expect(t, next(t, events), Add, "a")
+
+	//the delete is found but never received before Stop
+	if err := os.Remove(filepath.Join(dir, "a")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Start(dir); err != nil {
+		t.Fatal(err)
+	}
+	events = m.Events()
+	expect(t, next(t, events), Delete, "a")
+	silent(t, events, 200*time.Millisecond)
+}
+
+func TestCallbackPanicUnreported(t *testing.T) {
+	//without OnError a panic is not swallowed, however callbacks run
+	for _, workers := range []int{0, 2} {
+		dir := t.TempDir()
+		write(t, dir, "a", "")
+		write(t, dir, "b", "")
+		m := &Monitor{Concurrency: workers}
+		got := func() (r interface{}) {
+			defer func() { r = recover() }()
+			m.run(context.Background(), dir, func(ev Event) error { panic("boom") })
+			return nil
+		}()
+		if got == nil {
+			t.Fatalf("panic swallowed with Concurrency %d", workers)
+		}
+		if workers > 1 {
+			if err, ok := got.(error); !ok || !errors.Is(err, ErrCallbackPanic) {
+				t.Fatalf("got %v raised again, want ErrCallbackPanic", got)
+			}
+		} else if got != "boom" {
+			t.Fatalf("got %v, want the panic itself", got)
+		}
+	}
+}
+
+func TestSkipActiveModify(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a")
+	write(t, dir, "a", "one")
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	const quiet = 300 * time.Millisecond
+	m := &Monitor{SkipActive: quiet}
+	events := start(t, m, dir)
+	expect(t, next(t, events), Add, "a")
+
+	//a file rewritten in bursts is reported once, after it goes quiet
+	write(t, dir, "a", "two")
+	time.Sleep(quiet / 2)
+	write(t, dir, "a", "three")
+	last := time.Now()
+	ev := next(t, events)
+	expect(t, ev, Modify, "a")
+	if waited := time.Since(last); waited < quiet-50*time.Millisecond {
+		t.Fatalf("reported %v after the last write, before it went quiet", waited)
+	}
+	if ev.Info.Size() != 5 {
+		t.Fatalf("got size %d, want the finished file", ev.Info.Size())
+	}
+	silent(t, events, quiet)
+}
+
+// retrying runs m over dir in the background, polling quickly, passing
+// changes to deliver as DirectoryErr would, and stops it when the test
+// ends
+func retrying(t *testing.T, m *Monitor, dir string, deliver func(Event) error) {
+	t.Helper()
+	if err := m.SetInterval(20 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.run(ctx, dir, deliver)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// called returns the next call recorded on calls, failing the test if
+// none arrives in time
+func called(t *testing.T, calls <-chan string) string {
+	t.Helper()
+	select {
+	case call := <-calls:
+		return call
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a callback")
+	}
+	return ""
+}
+
+func TestRetry(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "a", "one")
+	calls := make(chan string, 100)
+	failures := 2
+	m := &Monitor{}
+	retrying(t, m, dir, m.byOp(func(name string) error {
+		calls <- "add " + name
+		if failures > 0 {
+			failures--
+			return errors.New("not yet")
+		}
+		return nil
+	}, nil))
+
+	for i := 0; i < 3; i++ {
+		if call := called(t, calls); call != "add a" {
+			t.Fatalf("got %q, want add a", call)
+		}
+	}
+	eventually(t, func() bool { return m.TotalSize() == 3 })
+	select {
+	case call := <-calls:
+		t.Fatalf("got %q after the add succeeded", call)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRetryGiveUp(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "a", "")
+	calls := make(chan string, 100)
+	errs := make(chan error, 10)
+	boom := errors.New("boom")
+	m := &Monitor{MaxRetries: 2, OnError: func(err error) { errs <- err }}
+	retrying(t, m, dir, m.byOp(func(name string) error {
+		calls <- "add " + name
+		return boom
+	}, nil))
+
+	//the first delivery and two retries, then the last error is reported
+	for i := 0; i < 3; i++ {
+		if call := called(t, calls); call != "add a" {
+			t.Fatalf("got %q, want add a", call)
+		}
+	}
+	select {
+	case err := <-errs:
+		if !errors.Is(err, boom) {
+			t.Fatalf("got %v, want the callback's error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("giving up was not reported")
+	}
+	select {
+	case call := <-calls:
+		t.Fatalf("got %q after giving up", call)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRetryRename(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "a", "contents")
+	calls := make(chan string, 100)
+	fail := true
+	m := &Monitor{DetectRenames: true}
+	retrying(t, m, dir, m.byOp(func(name string) error {
+		calls <- "add " + name
+		return nil
+	}, func(name string) error {
+		calls <- "delete " + name
+		if fail {
+			fail = false
+			return errors.New("not yet")
+		}
+		return nil
+	}))
+	if call := called(t, calls); call != "add a" {
+		t.Fatalf("got %q, want add a", call)
+	}
+
+	//the add half is not made when the delete half fails, and the whole
+	//rename is found again
+	if err := os.Rename(filepath.Join(dir, "a"), filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"delete a", "delete a", "add b"} {
+		if call := called(t, calls); call != want {
+			t.Fatalf("got %q, want %q", call, want)
+		}
+	}
+	eventually(t, func() bool { return m.TotalSize() == 8 })
+}
+
+func TestRetryDeleteModify(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "a", "one")
+	write(t, dir, "b", "two")
+	calls := make(chan string, 100)
+	failed := make(map[Op]bool)
+	m := &Monitor{}
+	retrying(t, m, dir, func(ev Event) error {
+		if ev.Op == Add {
+			return nil
+		}
+		calls <- fmt.Sprintf("%v %s", ev.Op, ev.Name)
+		if !failed[ev.Op] {
+			failed[ev.Op] = true
+			return errors.New("not yet")
+		}
+		return nil
+	})
+	eventually(t, func() bool { return m.TotalSize() == 6 })
+
+	if err := os.Remove(filepath.Join(dir, "a")); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("%v a", Delete)
+	for i := 0; i < 2; i++ {
+		if call := called(t, calls); call != want {
+			t.Fatalf("got %q, want %q", call, want)
+		}
+	}
+	eventually(t, func() bool { return m.TotalSize() == 3 })
+
+	replace(t, filepath.Join(dir, "b"), "three", time.Now().Add(time.Hour))
+	want = fmt.Sprintf("%v b", Modify)
+	for i := 0; i < 2; i++ {
+		if call := called(t, calls); call != want {
+			t.Fatalf("got %q, want %q", call, want)
+		}
+	}
+	eventually(t, func() bool { return m.TotalSize() == 5 })
+	select {
+	case call := <-calls:
+		t.Fatalf("got %q once every change succeeded", call)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRollback(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "a", "one")
+	write(t, dir, "b", "three")
+	small, err := os.Lstat(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, err := os.Lstat(filepath.Join(dir, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		op       Op
+		tracked  os.FileInfo //what is tracked as x after the change
+		change   Event
+		restored os.FileInfo //what should be tracked as x again, if anything
+	}{
+		{Add, small, Event{Name: "x", Op: Add, Info: small}, nil},
+		{Delete, nil, Event{Name: "x", Op: Delete, Info: small}, small},
+		{Modify, large, Event{Name: "x", Op: Modify, Info: large, prev: &entry{info: small}}, small},
+		{Rename, nil, Event{Name: "y", OldName: "x", Op: Rename, Info: large, prev: &entry{info: small}}, small},
+	}
+	for _, test := range tests {
+		m := &Monitor{contents: make(map[string]*entry)}
+		if test.tracked != nil {
+			m.contents["x"] = &entry{info: test.tracked}
+			m.addSize(sizeOf(test.tracked))
+		}
+		if test.op == Rename {
+			m.contents["y"] = &entry{info: large}
+			m.addSize(sizeOf(large))
+		}
+
+		m.retry([]failure{{Event: test.change, err: errors.New("failed")}})
+		value, ok := m.contents["x"]
+		switch {
+		case test.restored == nil && ok:
+			t.Errorf("%v: x is still tracked", test.op)
+		case test.restored != nil && (!ok || value.info != test.restored):
+			t.Errorf("%v: x is not tracked as it was", test.op)
+		}
+		if _, ok := m.contents["y"]; ok {
+			t.Errorf("%v: y is still tracked", test.op)
+		}
+		if got, want := m.TotalSize(), sizeOf(test.restored); got != want {
+			t.Errorf("%v: got TotalSize %d, want %d", test.op, got, want)
+		}
+	}
+}
+
+func TestPollTimeout(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "a", "")
+
+	m := &Monitor{}
+	if err := m.buildContents(dir); err != nil {
+		t.Fatal(err)
+	}
+	//enough files that listing them is slower than any timeout below
+	for i := 0; i < 5000; i++ {
+		write(t, dir, fmt.Sprintf("f%04d", i), "")
+	}
+
+	m.PollTimeout = time.Nanosecond
+	_, err := m.getDiff(dir)
+	if !errors.Is(err, ErrPollTimeout) {
+		t.Fatalf("got %v, want ErrPollTimeout", err)
+	}
+	reading := m.reading
+	var changes []Event
+	for {
+		if len(m.contents) != 1 {
+			t.Fatalf("got %d entries tracked after a timeout, want 1", len(m.contents))
+		}
+		changes, err = m.getDiff(dir)
+		if !errors.Is(err, ErrPollTimeout) {
+			break
+		}
+		if m.reading != reading {
+			t.Fatal("a second read was started while the first was still going")
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 5000 || m.reading != nil {
+		t.Fatalf("got %d changes from the finished read, want 5000", len(changes))
+	}
+
+	//a timeout while polling is reported, and monitoring carries on
+	errs := make(chan error, 100)
+	m = &Monitor{OnError: func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}}
+	retrying(t, m, dir, func(ev Event) error {
+		m.PollTimeout = time.Nanosecond //only once the initial listing is in
+		return nil
+	})
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrPollTimeout) {
+			t.Fatalf("got %v, want ErrPollTimeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the timeout was not reported")
+	}
+}
+
+func TestMatchName(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		name     string
+		elements bool
+		want     bool
+	}{
+		{"*.go", "main.go", false, true},
+		{"*.go", filepath.Join("cmd", "main.go"), false, true},
+		{"cmd", filepath.Join("cmd", "main.go"), false, false},
+		{"cmd", filepath.Join("cmd", "main.go"), true, true},
+		{".git", filepath.Join("a", ".git", "HEAD"), true, true},
+		{"cmd/*.go", filepath.Join("cmd", "main.go"), false, true},
+		{"cmd/*.go", filepath.Join("x", "cmd", "main.go"), true, false},
+		{"*/main.go", filepath.Join("cmd", "main.go"), false, true},
+		{"*/main.go", "main.go", true, false},
+		{"[", "[", false, false},
+	}
+	for _, test := range tests {
+		if got := matchName([]string{test.pattern}, test.name, test.elements); got != test.want {
+			t.Errorf("%q against %q (elements %v): got %v, want %v", test.pattern, test.name, test.elements, got, test.want)
+		}
+	}
+	if matchName(nil, "a", true) {
+		t.Error("no patterns matched")
+	}
+}
+
+func TestExclude(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "main.go", "")
+	write(t, dir, "notes.txt", "")
+	write(t, dir, "main.go.swp", "")
+	write(t, dir, ".git/HEAD", "")
+	write(t, dir, "docs/guide.md", "")
+	write(t, dir, "lib/docs/api.go", "")
+
+	m := &Monitor{Recursive: true}
+	m.Include = []string{"*.go"}
+	m.Exclude = []string{".git", "*.swp", "docs/*"}
+	events := start(t, m, dir)
+	//docs itself is not matched by docs/*, and Include leaves directories be
+	for _, name := range []string{"docs", "lib", filepath.Join("lib", "docs"), filepath.Join("lib", "docs", "api.go"), "main.go"} {
+		expect(t, next(t, events), Add, name)
+	}
+	silent(t, events, 100*time.Millisecond)
+
+	write(t, dir, ".git/objects/x", "")
+	write(t, dir, "docs/more/y.go", "")
+	write(t, dir, "lib/z.go.swp", "")
+	silent(t, events, 200*time.Millisecond)
+	write(t, dir, "lib/z.go", "")
+	expect(t, next(t, events), Add, filepath.Join("lib", "z.go"))
+}
+
+func TestIgnoreHidden(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "a", "")
+	write(t, dir, ".hidden", "")
+	write(t, dir, ".cache/b", "")
+	write(t, dir, "sub/.c", "")
+
+	m := &Monitor{Recursive: true}
+	m.IgnoreHidden = true
+	events := start(t, m, dir)
+	expect(t, next(t, events), Add, "a")
+	expect(t, next(t, events), Add, "sub")
+	silent(t, events, 100*time.Millisecond)
+
+	write(t, dir, ".cache/d", "")
+	write(t, dir, "sub/.e", "")
+	silent(t, events, 200*time.Millisecond)
+}
+
+func TestDebounce(t *testing.T) {
+	m := &Monitor{}
+	m.Debounce = 100 * time.Millisecond
+	base := time.Now()
+	at := func(d time.Duration) time.Time { return base.Add(d) }
+
+	if got := m.debounce([]Event{{Name: "a", Op: Add}, {Name: "b", Op: Add}}, at(0)); len(got) != 0 {
+		t.Fatalf("got %v before anything settled", got)
+	}
+	//a changing again restarts its own wait but not b's
+	if got := m.debounce([]Event{{Name: "a", Op: Modify}}, at(60*time.Millisecond)); len(got) != 0 {
+		t.Fatalf("got %v before anything settled", got)
+	}
+	got := m.debounce(nil, at(120*time.Millisecond))
+	if len(got) != 1 {
+		t.Fatalf("got %v, want only b", got)
+	}
+	expect(t, got[0], Add, "b")
+	if d, ok := m.due(at(120 * time.Millisecond)); !ok || d != 40*time.Millisecond {
+		t.Fatalf("got %v, %v until a is due, want 40ms", d, ok)
+	}
+
+	//an add followed by a modify is delivered as the add
+	got = m.debounce(nil, at(160*time.Millisecond))
+	if len(got) != 1 {
+		t.Fatalf("got %v, want only a", got)
+	}
+	expect(t, got[0], Add, "a")
+	if _, ok := m.due(at(160 * time.Millisecond)); ok {
+		t.Fatal("changes are still due once everything was delivered")
+	}
+}
+
+func TestStreamChunk(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 5; i++ {
+		write(t, dir, fmt.Sprintf("old%d", i), "")
+	}
+	m := &Monitor{StreamChunk: 2}
+	events := start(t, m, dir)
+	for i := 0; i < 5; i++ {
+		expect(t, next(t, events), Add, fmt.Sprintf("old%d", i))
+	}
+
+	want := make(map[string]Op)
+	for i := 0; i < 5; i++ {
+		write(t, dir, fmt.Sprintf("new%d", i), "")
+		want[fmt.Sprintf("new%d", i)] = Add
+	}
+	for i := 0; i < 3; i++ {
+		if err := os.Remove(filepath.Join(dir, fmt.Sprintf("old%d", i))); err != nil {
+			t.Fatal(err)
+		}
+		want[fmt.Sprintf("old%d", i)] = Delete
+	}
+
+	//adds come in the order the directory is read, so only the set counts
+	for len(want) > 0 {
+		ev := next(t, events)
+		if op, ok := want[ev.Name]; !ok || op != ev.Op {
+			t.Fatalf("got unexpected %v on %q", ev.Op, ev.Name)
+		}
+		delete(want, ev.Name)
+	}
+	silent(t, events, 200*time.Millisecond)
+}
+
+func TestSince(t *testing.T) {
+	m := &Monitor{History: 3}
+	var changes []Event
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		changes = append(changes, Event{Name: name, Op: Add})
+	}
+	m.number(changes)
+
+	//the history only goes back to c, so anyone who missed b missed too much
+	for _, seq := range []uint64{0, 1} {
+		if events, ok := m.Since(seq); ok || events != nil {
+			t.Fatalf("Since(%d): got %v, %v after the history was trimmed", seq, events, ok)
+		}
+	}
+	for seq, want := range map[uint64][]string{2: {"c", "d", "e"}, 3: {"d", "e"}, 4: {"e"}} {
+		events, ok := m.Since(seq)
+		if !ok || len(events) != len(want) {
+			t.Fatalf("Since(%d): got %v, %v, want %v", seq, events, ok, want)
+		}
+		for i, ev := range events {
+			if ev.Name != want[i] || ev.Seq != seq+1+uint64(i) {
+				t.Fatalf("Since(%d): got %q numbered %d at %d", seq, ev.Name, ev.Seq, i)
+			}
+		}
+	}
+	if events, ok := m.Since(5); !ok || events != nil {
+		t.Fatalf("Since(5): got %v, %v once caught up", events, ok)
+	}
+}
+
+func TestOnExt(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "a.TXT", "")
+	write(t, dir, "b.go", "")
+
+	routed := make(chan string, 10)
+	added := make(chan string, 10)
+	m := &Monitor{}
+	m.OnExt("txt", func(ev Event) { routed <- ev.Name })
+	if err := m.SetInterval(20 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- m.DirectoryContext(ctx, dir, func(name string) { added <- name }, nil)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	if got := called(t, routed); got != "a.TXT" {
+		t.Fatalf("got %q routed, want a.TXT", got)
+	}
+	if got := called(t, added); got != "b.go" {
+		t.Fatalf("got %q added, want b.go", got)
+	}
+
+	//Start has no callbacks to replace, so everything stays on the channel
+	m = &Monitor{}
+	m.OnExt("txt", func(ev Event) { routed <- ev.Name })
+	events := start(t, m, dir)
+	expect(t, next(t, events), Add, "a.TXT")
+	expect(t, next(t, events), Add, "b.go")
+	select {
+	case name := <-routed:
+		t.Fatalf("got %q routed under Start", name)
+	default:
+	}
+}
@@ -0,0 +1,161 @@
+package fsUtils
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// notifyDelay is how long a Monitor lets a burst of notifications settle
+// before polling
+const notifyDelay = 50 * time.Millisecond
+
+// errNoNotify is returned by newNotifier on platforms without native
+// change notifications
+var errNoNotify = errors.New("fsUtils: native notifications not supported")
+
+// notifier is a platform's native change notifications for a directory,
+// used to wake a Monitor early rather than to say what changed
+type notifier interface {
+	//wake receives a value whenever something may have changed
+	wake() <-chan struct{}
+
+	//overflowed reports whether the platform has dropped notifications
+	//since it was last asked, clearing the report
+	overflowed() bool
+
+	//watch sets the subdirectories the notifier watches as well as its
+	//root, for platforms that have to watch each directory separately
+	watch(dirs []string) error
+
+	close()
+
+	//name is the backend reported by Monitor.Backend
+	name() string
+}
+
+// notify sets up native change notifications for directoryName, returning
+// nil if the monitor has to rely on polling alone
+func (m *Monitor) notify(directoryName string) notifier {
+	if m.PollOnly {
+		return nil
+	}
+	n, err := newNotifier(directoryName, m.Recursive || m.subdirs != "")
+	if err != nil {
+		if !errors.Is(err, errNoNotify) {
+			m.report(err)
+		}
+		return nil
+	}
+	return n
+}
+
+// rewatch brings the subdirectories n watches into line with what is
+// being tracked, falling back to polling if they cannot all be watched
+func (m *Monitor) rewatch(n notifier, directoryName string) notifier {
+	if n == nil || (!m.Recursive && m.subdirs == "") {
+		return n
+	}
+	err := n.watch(m.watchable(directoryName))
+	if err != nil {
+		m.report(err)
+		n.close()
+		m.setBackend(backendOf(nil))
+		return nil
+	}
+	return n
+}
+
+// backendOf names the backend a monitor watching with n is using, which
+// is polling when n is nil
+func backendOf(n notifier) string {
+	if n == nil {
+		return "poll"
+	}
+	return n.name()
+}
+
+// setBackend records the backend in use, telling OnBackendChange when it
+// changes. Clearing it when monitoring ends is not reported.
+func (m *Monitor) setBackend(backend string) {
+	m.mu.Lock()
+	changed := backend != m.backend
+	m.backend = backend
+	m.mu.Unlock()
+	if changed && backend != "" && m.OnBackendChange != nil {
+		m.OnBackendChange(backend)
+	}
+}
+
+// watchable returns the directories below directoryName that changes
+// can turn up in
+func (m *Monitor) watchable(directoryName string) []string {
+	var dirs []string
+	if m.subdirs != "" {
+		dirents, _ := m.matchSubdirs(directoryName)
+		for _, dirent := range dirents {
+			dirs = append(dirs, filepath.Join(directoryName, dirent.Name()))
+		}
+	}
+	if m.Recursive {
+		for name, value := range m.contents {
+			if value.dirent != nil && value.dirent.IsDir() {
+				dirs = append(dirs, filepath.Join(directoryName, name))
+			}
+		}
+	}
+	return dirs
+}
+
+// wait sleeps until the next poll is due, which is after the poll interval
+// or shortly after n reports a change, returning false if ctx is done first
+func (m *Monitor) wait(ctx context.Context, n notifier) bool {
+	if n == nil {
+		return sleep(ctx, m.nextPoll())
+	}
+
+	timer := time.NewTimer(m.nextPoll())
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	case <-n.wake():
+	}
+
+	//notifications were lost, so poll straight away to find what they held
+	if n.overflowed() {
+		m.report(&os.PathError{Op: "notify", Path: m.dir, Err: ErrNotifyOverflow})
+		return true
+	}
+	if !sleep(ctx, notifyDelay) {
+		return false
+	}
+	//whatever arrived while settling is covered by the coming poll
+	select {
+	case <-n.wake():
+	default:
+	}
+	return true
+}
+
+// signal wakes whoever is waiting on c without blocking
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// watchedDir reports whether path is still a directory worth watching,
+// which is not the case if it has since been removed or replaced
+func watchedDir(path string) (os.FileInfo, bool) {
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return nil, false
+	}
+	return info, true
+}
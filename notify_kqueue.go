@@ -0,0 +1,169 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package fsUtils
+
+import (
+	"os"
+	"syscall"
+)
+
+// kqueueFlags is the vnode events that wake a Monitor. A directory's
+// vnode only changes when entries are added, removed or renamed, so
+// changes to files already there are left to the regular polls.
+const kqueueFlags = syscall.NOTE_WRITE | syscall.NOTE_DELETE | syscall.NOTE_RENAME |
+	syscall.NOTE_EXTEND | syscall.NOTE_ATTRIB
+
+// kqueue notifies of changes through the BSD kqueue
+type kqueue struct {
+	kq      int
+	root    string
+	stop    [2]int //pipe whose closing interrupts read
+	watches map[string]watched
+	woken   chan struct{}
+	done    chan struct{}
+}
+
+// watched is a directory a kqueue holds open
+type watched struct {
+	fd       int
+	dev, ino uint64
+}
+
+func newNotifier(root string, tree bool) (notifier, error) {
+	kq, err := syscall.Kqueue()
+	if err != nil {
+		return nil, os.NewSyscallError("kqueue", err)
+	}
+	syscall.CloseOnExec(kq)
+	n := &kqueue{
+		kq:      kq,
+		root:    root,
+		watches: make(map[string]watched),
+		woken:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	err = syscall.Pipe(n.stop[:])
+	if err != nil {
+		syscall.Close(kq)
+		return nil, os.NewSyscallError("pipe", err)
+	}
+	syscall.CloseOnExec(n.stop[0])
+	syscall.CloseOnExec(n.stop[1])
+	var ev syscall.Kevent_t
+	syscall.SetKevent(&ev, n.stop[0], syscall.EVFILT_READ, syscall.EV_ADD)
+	_, err = syscall.Kevent(kq, []syscall.Kevent_t{ev}, nil, nil)
+	if err == nil {
+		err = n.add(root)
+	}
+	if err != nil {
+		syscall.Close(n.stop[0])
+		syscall.Close(n.stop[1])
+		n.release()
+		return nil, err
+	}
+	go n.read()
+	return n, nil
+}
+
+// add opens dir and registers it with the kqueue, reopening it if the
+// path now names a different directory
+func (n *kqueue) add(dir string) error {
+	info, ok := watchedDir(dir)
+	if !ok {
+		return nil
+	}
+	dev, ino, _ := fileID(info)
+	if w, ok := n.watches[dir]; ok {
+		if w.dev == dev && w.ino == ino {
+			return nil
+		}
+		syscall.Close(w.fd)
+		delete(n.watches, dir)
+	}
+
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		if err == syscall.ENOENT || err == syscall.ENOTDIR {
+			return nil
+		}
+		return &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+	var ev syscall.Kevent_t
+	syscall.SetKevent(&ev, fd, syscall.EVFILT_VNODE, syscall.EV_ADD|syscall.EV_CLEAR)
+	ev.Fflags = kqueueFlags
+	_, err = syscall.Kevent(n.kq, []syscall.Kevent_t{ev}, nil, nil)
+	if err != nil {
+		syscall.Close(fd)
+		return &os.PathError{Op: "kevent", Path: dir, Err: err}
+	}
+	n.watches[dir] = watched{fd: fd, dev: dev, ino: ino}
+	return nil
+}
+
+// read wakes the monitor for every batch of events until stop is closed
+func (n *kqueue) read() {
+	defer close(n.done)
+	events := make([]syscall.Kevent_t, 16)
+	for {
+		k, err := syscall.Kevent(n.kq, nil, events, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		for _, ev := range events[:k] {
+			if int(ev.Ident) == n.stop[0] {
+				return
+			}
+		}
+		signal(n.woken)
+	}
+}
+
+func (n *kqueue) wake() <-chan struct{} {
+	return n.woken
+}
+
+// kqueue keeps a single event per vnode, which cannot overflow
+func (n *kqueue) overflowed() bool {
+	return false
+}
+
+func (n *kqueue) watch(dirs []string) error {
+	want := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		want[dir] = true
+		err := n.add(dir)
+		if err != nil {
+			return err
+		}
+	}
+	for dir, w := range n.watches {
+		if !want[dir] && dir != n.root {
+			syscall.Close(w.fd)
+			delete(n.watches, dir)
+		}
+	}
+	return nil
+}
+
+func (n *kqueue) close() {
+	syscall.Close(n.stop[1])
+	<-n.done
+	syscall.Close(n.stop[0])
+	n.release()
+}
+
+// release closes the kqueue and every directory it holds open
+func (n *kqueue) release() {
+	for _, w := range n.watches {
+		syscall.Close(w.fd)
+	}
+	syscall.Close(n.kq)
+}
+
+func (n *kqueue) name() string {
+	return "kqueue"
+}
@@ -0,0 +1,119 @@
+//go:build linux
+
+package fsUtils
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// inotifyMask is the events that wake a Monitor
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+	syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF | syscall.IN_ONLYDIR
+
+// inotify notifies of changes through Linux's inotify
+type inotify struct {
+	fd      int
+	file    *os.File       //fd wrapped so reads can be interrupted by closing it
+	watches map[string]int //watch descriptors by subdirectory
+	woken   chan struct{}
+	done    chan struct{}
+	lost    int32 //set when the kernel reports IN_Q_OVERFLOW
+}
+
+func newNotifier(root string, tree bool) (notifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	n := &inotify{
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		watches: make(map[string]int),
+		woken:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	_, err = syscall.InotifyAddWatch(fd, root, inotifyMask)
+	if err != nil {
+		n.file.Close()
+		return nil, &os.PathError{Op: "inotify_add_watch", Path: root, Err: err}
+	}
+	go n.read()
+	return n, nil
+}
+
+// read wakes the monitor for every batch of events, noting an overflow
+func (n *inotify) read() {
+	defer close(n.done)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		count, err := n.file.Read(buf)
+		if err != nil {
+			return
+		}
+		if overflowed(buf[:count]) {
+			atomic.StoreInt32(&n.lost, 1)
+		}
+		signal(n.woken)
+	}
+}
+
+// overflowed reports whether any of the inotify events in buf says the
+// kernel's queue overflowed
+func overflowed(buf []byte) bool {
+	for len(buf) >= syscall.SizeofInotifyEvent {
+		event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[0]))
+		if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+			return true
+		}
+		size := syscall.SizeofInotifyEvent + int(event.Len)
+		if size > len(buf) {
+			break
+		}
+		buf = buf[size:]
+	}
+	return false
+}
+
+func (n *inotify) wake() <-chan struct{} {
+	return n.woken
+}
+
+func (n *inotify) overflowed() bool {
+	return atomic.SwapInt32(&n.lost, 0) != 0
+}
+
+func (n *inotify) watch(dirs []string) error {
+	want := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		want[dir] = true
+		//adding again is cheap and picks up a directory that was replaced
+		wd, err := syscall.InotifyAddWatch(n.fd, dir, inotifyMask)
+		if err == syscall.ENOENT || err == syscall.ENOTDIR {
+			continue
+		}
+		if err != nil {
+			return &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+		}
+		n.watches[dir] = wd
+	}
+	for dir, wd := range n.watches {
+		if !want[dir] {
+			syscall.InotifyRmWatch(n.fd, uint32(wd))
+			delete(n.watches, dir)
+		}
+	}
+	return nil
+}
+
+func (n *inotify) close() {
+	n.file.Close()
+	<-n.done
+}
+
+func (n *inotify) name() string {
+	return "inotify"
+}
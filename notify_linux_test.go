@@ -0,0 +1,30 @@
+//go:build linux
+
+package fsUtils
+
+import (
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestInotifyOverflowed(t *testing.T) {
+	const name = 16 //bytes of name following the first event
+	buf := make([]byte, 2*syscall.SizeofInotifyEvent+name)
+	first := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[0]))
+	first.Mask = syscall.IN_CREATE
+	first.Len = name
+	second := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[syscall.SizeofInotifyEvent+name]))
+	second.Wd = -1
+	second.Mask = syscall.IN_Q_OVERFLOW
+
+	if overflowed(buf[:syscall.SizeofInotifyEvent+name]) {
+		t.Error("an ordinary event was taken for an overflow")
+	}
+	if !overflowed(buf) {
+		t.Error("the overflow after another event was missed")
+	}
+	if overflowed(buf[:syscall.SizeofInotifyEvent]) {
+		t.Error("a truncated event was read past")
+	}
+}
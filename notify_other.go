@@ -0,0 +1,8 @@
+//go:build !linux && !windows && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package fsUtils
+
+// native notifications are not available on this platform
+func newNotifier(root string, tree bool) (notifier, error) {
+	return nil, errNoNotify
+}
@@ -0,0 +1,56 @@
+package fsUtils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// woken is a notifier a test wakes by hand
+type woken struct {
+	c    chan struct{}
+	lost bool
+}
+
+func (n *woken) wake() <-chan struct{}     { return n.c }
+func (n *woken) overflowed() bool          { lost := n.lost; n.lost = false; return lost }
+func (n *woken) watch(dirs []string) error { return nil }
+func (n *woken) close()                    {}
+func (n *woken) name() string              { return "test" }
+
+func TestNotifyOverflow(t *testing.T) {
+	var errs []error
+	m := &Monitor{OnError: func(err error) { errs = append(errs, err) }}
+	if err := m.SetInterval(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	//an ordinary notification is left to settle before polling
+	n := &woken{c: make(chan struct{}, 1)}
+	n.c <- struct{}{}
+	began := time.Now()
+	if !m.wait(ctx, n) {
+		t.Fatal("wait gave up")
+	}
+	if took := time.Since(began); took < notifyDelay {
+		t.Fatalf("polled after %v, before the notification settled", took)
+	}
+	if len(errs) != 0 {
+		t.Fatalf("got errors %v", errs)
+	}
+
+	n.lost = true
+	n.c <- struct{}{}
+	began = time.Now()
+	if !m.wait(ctx, n) {
+		t.Fatal("wait gave up")
+	}
+	if took := time.Since(began); took >= notifyDelay {
+		t.Fatalf("polled after %v, want straight away after an overflow", took)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], ErrNotifyOverflow) {
+		t.Fatalf("got errors %v, want ErrNotifyOverflow", errs)
+	}
+}
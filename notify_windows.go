@@ -0,0 +1,101 @@
+//go:build windows
+
+package fsUtils
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+// dirChangesMask is the changes that wake a Monitor
+const dirChangesMask = syscall.FILE_NOTIFY_CHANGE_FILE_NAME | syscall.FILE_NOTIFY_CHANGE_DIR_NAME |
+	syscall.FILE_NOTIFY_CHANGE_ATTRIBUTES | syscall.FILE_NOTIFY_CHANGE_SIZE |
+	syscall.FILE_NOTIFY_CHANGE_LAST_WRITE | syscall.FILE_NOTIFY_CHANGE_CREATION
+
+// dirChanges notifies of changes through ReadDirectoryChangesW, which
+// covers a whole tree from a single handle when asked to
+type dirChanges struct {
+	handle syscall.Handle
+	port   syscall.Handle //completion port the reads finish on
+	tree   bool
+	woken  chan struct{}
+	done   chan struct{}
+	lost   int32 //set when a read overflowed its buffer
+}
+
+func newNotifier(root string, tree bool) (notifier, error) {
+	path, err := syscall.UTF16PtrFromString(root)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := syscall.CreateFile(path, syscall.FILE_LIST_DIRECTORY,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE, nil,
+		syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS|syscall.FILE_FLAG_OVERLAPPED, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "CreateFile", Path: root, Err: err}
+	}
+	port, err := syscall.CreateIoCompletionPort(handle, 0, 0, 0)
+	if err != nil {
+		syscall.CloseHandle(handle)
+		return nil, os.NewSyscallError("CreateIoCompletionPort", err)
+	}
+
+	n := &dirChanges{
+		handle: handle,
+		port:   port,
+		tree:   tree,
+		woken:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go n.read()
+	return n, nil
+}
+
+// read wakes the monitor every time a read of the changes completes, until
+// the handle is closed. A read that overflowed completes with no bytes.
+func (n *dirChanges) read() {
+	defer close(n.done)
+	buf := make([]byte, 64*1024)
+	var ov syscall.Overlapped
+	for {
+		err := syscall.ReadDirectoryChanges(n.handle, &buf[0], uint32(len(buf)), n.tree, dirChangesMask, nil, &ov, 0)
+		if err != nil {
+			return
+		}
+		var qty, key uint32
+		var done *syscall.Overlapped
+		err = syscall.GetQueuedCompletionStatus(n.port, &qty, &key, &done, syscall.INFINITE)
+		if err != nil {
+			return
+		}
+		if qty == 0 {
+			atomic.StoreInt32(&n.lost, 1)
+		}
+		signal(n.woken)
+	}
+}
+
+func (n *dirChanges) wake() <-chan struct{} {
+	return n.woken
+}
+
+func (n *dirChanges) overflowed() bool {
+	return atomic.SwapInt32(&n.lost, 0) != 0
+}
+
+// the handle on the root already covers the tree
+func (n *dirChanges) watch(dirs []string) error {
+	return nil
+}
+
+func (n *dirChanges) close() {
+	//closing the handle cancels the outstanding read, which ends read
+	syscall.CloseHandle(n.handle)
+	<-n.done
+	syscall.CloseHandle(n.port)
+}
+
+func (n *dirChanges) name() string {
+	return "ReadDirectoryChangesW"
+}
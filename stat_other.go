@@ -0,0 +1,25 @@
+//go:build !unix
+
+package fsUtils
+
+import "os"
+
+// link counts are not available from FileInfo on this platform
+func linkCount(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// ownership is not available from FileInfo on this platform
+func owner(info os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
+
+// inode numbers are not available from FileInfo on this platform
+func fileID(info os.FileInfo) (uint64, uint64, bool) {
+	return 0, 0, false
+}
+
+// mountpoints cannot be told apart from FileInfo on this platform
+func isMountpoint(dir string, info os.FileInfo) bool {
+	return false
+}
@@ -0,0 +1,57 @@
+//go:build unix
+
+package fsUtils
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+func linkCount(info os.FileInfo) (uint64, bool) {
+	if info == nil {
+		return 0, false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Nlink), true
+}
+
+func owner(info os.FileInfo) (int, int, bool) {
+	if info == nil {
+		return 0, 0, false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// fileID returns the device and inode numbers of a file
+func fileID(info os.FileInfo) (uint64, uint64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(st.Dev), uint64(st.Ino), true
+}
+
+// isMountpoint reports whether dir sits on a different device to its parent
+func isMountpoint(dir string, info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	parent, err := os.Stat(filepath.Join(dir, ".."))
+	if err != nil {
+		return false
+	}
+	pst, ok := parent.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	return st.Dev != pst.Dev
+}
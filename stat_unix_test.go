@@ -0,0 +1,62 @@
+//go:build unix
+
+package fsUtils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWatchLinks(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "a", "data")
+	m := &Monitor{WatchLinks: true}
+	events := start(t, m, dir)
+	ev := next(t, events)
+	expect(t, ev, Add, "a")
+	if n, ok := ev.Links(); !ok || n != 1 {
+		t.Fatalf("got %d links, %v, want 1", n, ok)
+	}
+
+	//a link made outside the watched directory only shows in the count
+	if err := os.Link(filepath.Join(dir, "a"), filepath.Join(t.TempDir(), "b")); err != nil {
+		t.Fatal(err)
+	}
+	ev = next(t, events)
+	expect(t, ev, Modify, "a")
+	if ev.Changed != ChangedLinks {
+		t.Fatalf("got Changed %b, want only ChangedLinks", ev.Changed)
+	}
+	if n, _ := ev.Links(); n != 2 {
+		t.Fatalf("got %d links after linking, want 2", n)
+	}
+}
+
+func TestWatchOwnership(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "a", "")
+	m := &Monitor{WatchOwnership: true}
+	events := start(t, m, dir)
+	ev := next(t, events)
+	expect(t, ev, Add, "a")
+	uid, gid, ok := ev.Owner()
+	if !ok || uid != os.Getuid() || gid != os.Getgid() {
+		t.Fatalf("got owner %d:%d, %v, want %d:%d", uid, gid, ok, os.Getuid(), os.Getgid())
+	}
+
+	if os.Getuid() != 0 {
+		t.Skip("changing a file's owner needs root")
+	}
+	if err := os.Chown(filepath.Join(dir, "a"), uid+1, gid+1); err != nil {
+		t.Fatal(err)
+	}
+	ev = next(t, events)
+	expect(t, ev, Modify, "a")
+	if ev.Changed != ChangedOwner {
+		t.Fatalf("got Changed %b, want only ChangedOwner", ev.Changed)
+	}
+	if uid, gid, _ := ev.Owner(); uid != os.Getuid()+1 || gid != os.Getgid()+1 {
+		t.Fatalf("got owner %d:%d after chown", uid, gid)
+	}
+}
@@ -0,0 +1,59 @@
+package fsUtils
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// saved is what a StateFile keeps about each tracked name, so that a
+// restarted monitor need not hash a file again unless it has changed
+type saved struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"` //in nanoseconds since the Unix epoch
+	Hash    string `json:"hash,omitempty"`
+}
+
+// loadState reads what was saved in a StateFile. Files written before
+// details were kept hold only a list of names, which load with none.
+func loadState(path string) (map[string]saved, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state map[string]saved
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		var names []string
+		if json.Unmarshal(data, &names) != nil {
+			return nil, &os.PathError{Op: "load state", Path: path, Err: err}
+		}
+		state = make(map[string]saved, len(names))
+		for _, name := range names {
+			state[name] = saved{}
+		}
+	}
+	return state, nil
+}
+
+// saveState replaces the StateFile at path with state, writing to a
+// temporary file first so a crash never leaves a half written state
+func saveState(path string, state map[string]saved) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,289 @@
+package fsUtils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+ErrSyncOverlap is returned by Sync when one of the directories it is given is inside the other.
+*/
+var ErrSyncOverlap = errors.New("fsUtils: source and destination overlap")
+
+/*
+SyncOptions controls how Sync mirrors one directory onto another. Include, Exclude and IgnoreHidden leave entries out on both sides, so an excluded file is neither copied from the source nor removed from the destination, and Debounce settles changes in Continuous mode.
+*/
+type SyncOptions struct {
+	MonitorOptions
+
+	//Continuous keeps the destination up to date after the first mirror,
+	//applying changes to the source as a Monitor finds them, instead of
+	//returning. Renames in the source are carried over as renames where
+	//possible. A change that fails to apply is passed to OnError and
+	//tried again at the next poll.
+	Continuous bool
+
+	//Interval is how often Continuous mode polls the source, as with
+	//SetInterval. Zero uses the Monitor's default.
+	Interval time.Duration
+
+	//KeepStale leaves files the source lacks in the destination rather
+	//than removing them.
+	KeepStale bool
+
+	//HashContents compares the contents of files, not just their size
+	//and modification time, when deciding whether to copy them.
+	HashContents bool
+
+	//OnError, if set, is called with errors Sync carries on past.
+	OnError func(err error)
+}
+
+/*
+Sync mirrors the directory src onto dst, creating dst if need be. Files src has that dst lacks, or that differ in size, modification time or type, are copied, entries whose permissions differ are given the permissions from src, and files dst has that src lacks are removed unless KeepStale is set. Nothing is created when one directory is inside the other, which fails with ErrSyncOverlap. Only regular files, directories and symlinks are mirrored. Copies keep the permissions and modification time of the source, so a later Sync only copies what has changed since, and each file is written alongside its destination and renamed into place so that nothing reading dst sees half a file.
+
+Unless opts.Continuous is set, Sync returns once dst has been mirrored, with the first error it met, if any; later errors are passed to OnError. Changes made to dst by anything else while Continuous is set are not noticed until the next Sync.
+*/
+func Sync(src string, dst string, opts SyncOptions) error {
+	return SyncContext(context.Background(), src, dst, opts)
+}
+
+/*
+SyncContext is like Sync, except that it gives up and returns ctx's error once ctx is done. This is how Continuous mode is stopped.
+*/
+func SyncContext(ctx context.Context, src string, dst string, opts SyncOptions) error {
+	m := &Monitor{
+		MonitorOptions: opts.MonitorOptions,
+		Recursive:      true,
+		HashContents:   opts.HashContents,
+		WatchMode:      true,
+		DetectRenames:  true,
+		Reference:      dst,
+		OnError:        opts.OnError,
+	}
+	if opts.Interval > 0 {
+		err := m.SetInterval(opts.Interval)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := m.preflight(src)
+	if err != nil {
+		return err
+	}
+	err = checkOverlap(src, dst)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dst, 0777)
+	if err != nil {
+		return err
+	}
+
+	s := &syncer{src: src, dst: dst, keepStale: opts.KeepStale}
+	if opts.Continuous {
+		return m.run(ctx, src, func(ev Event) error {
+			err := s.apply(ev)
+			if err != nil {
+				m.report(err)
+			}
+			return err
+		})
+	}
+
+	err = m.seedReference(dst)
+	if err != nil {
+		return err
+	}
+	changes, err := m.getDiff(src)
+	if err != nil {
+		return err
+	}
+
+	var first error
+	for _, ev := range changes {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err := s.apply(ev)
+		if err != nil && first == nil {
+			first = err
+		} else if err != nil {
+			m.report(err)
+		}
+	}
+	return first
+}
+
+// checkOverlap fails with ErrSyncOverlap if src or dst is inside the other
+func checkOverlap(src string, dst string) error {
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+	dst, err = filepath.Abs(dst)
+	if err != nil {
+		return err
+	}
+	if within(src, dst) || within(dst, src) {
+		return &os.PathError{Op: "sync", Path: dst, Err: ErrSyncOverlap}
+	}
+	return nil
+}
+
+// within reports whether path is dir or somewhere below it
+func within(path string, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// syncer applies the changes a Monitor finds in src to dst
+type syncer struct {
+	src       string
+	dst       string
+	keepStale bool
+}
+
+// apply carries a single change over to dst
+func (s *syncer) apply(ev Event) error {
+	target := filepath.Join(s.dst, ev.Name)
+	switch ev.Op {
+	case Delete:
+		if s.keepStale {
+			return nil
+		}
+		return os.RemoveAll(target)
+	case Modify:
+		if ev.Changed == ChangedMode && ev.Info != nil {
+			return os.Chmod(target, ev.Info.Mode().Perm())
+		}
+	case Rename:
+		if s.keepStale {
+			return s.copy(ev.Name, false)
+		}
+		old := filepath.Join(s.dst, ev.OldName)
+		err := s.mkdirs(filepath.Dir(target))
+		if err == nil {
+			err = os.Rename(old, target)
+		}
+		if err == nil {
+			return nil
+		}
+		//the old name may have moved already along with its directory
+		err = s.copy(ev.Name, true)
+		if err != nil {
+			return err
+		}
+		return os.RemoveAll(old)
+	}
+	return s.copy(ev.Name, false)
+}
+
+// copy mirrors the entry name from src to dst. When lazy is true a file
+// dst already has with the same size and modification time is left be.
+func (s *syncer) copy(name string, lazy bool) error {
+	from := filepath.Join(s.src, name)
+	to := filepath.Join(s.dst, name)
+	info, err := os.Lstat(from)
+	if os.IsNotExist(err) {
+		return nil //removed again, which a later delete will catch
+	}
+	if err != nil {
+		return err
+	}
+	err = s.mkdirs(filepath.Dir(to))
+	if err != nil {
+		return err
+	}
+
+	existing, err := os.Lstat(to)
+	if err == nil {
+		switch {
+		case existing.Mode().Type() != info.Mode().Type():
+			err = os.RemoveAll(to)
+			if err != nil {
+				return err
+			}
+		case info.IsDir():
+			if existing.Mode().Perm() == info.Mode().Perm() {
+				return nil
+			}
+			return os.Chmod(to, info.Mode().Perm())
+		case lazy && existing.Size() == info.Size() && existing.ModTime().Equal(info.ModTime()):
+			return nil
+		}
+	}
+
+	switch {
+	case info.IsDir():
+		err = os.Mkdir(to, info.Mode().Perm())
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(from)
+		if err != nil {
+			return err
+		}
+		if current, err := os.Readlink(to); err == nil && current == link {
+			return nil //links cannot keep their times, so compare targets
+		}
+		err = os.Remove(to)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Symlink(link, to)
+	case info.Mode().IsRegular():
+		return copyFile(from, to, info)
+	}
+	return nil //other kinds of entry are not mirrored
+}
+
+// mkdirs makes sure dir is a directory, replacing a file in the way
+func (s *syncer) mkdirs(dir string) error {
+	info, err := os.Lstat(dir)
+	if err == nil && !info.IsDir() {
+		err = os.Remove(dir)
+		if err != nil {
+			return err
+		}
+	}
+	return os.MkdirAll(dir, 0777)
+}
+
+// copyFile copies the regular file from over to, writing to a temporary
+// file first and keeping the permissions and modification time in info
+func copyFile(from string, to string, info os.FileInfo) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(to), filepath.Base(to)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, in)
+	if err == nil {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime())
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), to)
+}
@@ -0,0 +1,177 @@
+package fsUtils
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// read returns the contents of the file name below dir, failing the test
+// if it cannot be read
+func read(t *testing.T, dir string, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// missing fails the test if name exists below dir
+func missing(t *testing.T, dir string, name string) {
+	t.Helper()
+	_, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(name)))
+	if !os.IsNotExist(err) {
+		t.Fatalf("%s: got %v, want it gone", name, err)
+	}
+}
+
+func TestSync(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	write(t, src, "a", "one")
+	write(t, src, "sub/b", "two")
+	write(t, dst, "stale", "")
+
+	if err := Sync(src, dst, SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(t, dst, "a"); got != "one" {
+		t.Fatalf("got %q in a", got)
+	}
+	if got := read(t, dst, "sub/b"); got != "two" {
+		t.Fatalf("got %q in sub/b", got)
+	}
+	missing(t, dst, "stale")
+
+	//a second run finds nothing to copy, so a file changed only in dst
+	//with the same size and time is left be
+	info, err := os.Stat(filepath.Join(dst, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, dst, "a", "ONE")
+	if err := os.Chtimes(filepath.Join(dst, "a"), info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err := Sync(src, dst, SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(t, dst, "a"); got != "ONE" {
+		t.Fatalf("got %q in a, want it left alone", got)
+	}
+}
+
+func TestSyncKeepStale(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	write(t, src, "a", "")
+	write(t, dst, "stale", "kept")
+
+	if err := Sync(src, dst, SyncOptions{KeepStale: true}); err != nil {
+		t.Fatal(err)
+	}
+	read(t, dst, "a")
+	if got := read(t, dst, "stale"); got != "kept" {
+		t.Fatalf("got %q in stale", got)
+	}
+}
+
+func TestSyncType(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	if err := os.Mkdir(filepath.Join(src, "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	write(t, dst, "x", "a file in the way")
+
+	if err := Sync(src, dst, SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(filepath.Join(dst, "x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() {
+		t.Fatalf("got mode %v, want a directory", info.Mode())
+	}
+}
+
+func TestSyncMode(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	write(t, src, "a", "")
+	if err := Sync(src, dst, SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(src, "a")
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Sync(src, dst, SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dst, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != want.Mode().Perm() {
+		t.Fatalf("got mode %v, want %v", info.Mode().Perm(), want.Mode().Perm())
+	}
+}
+
+func TestSyncOverlap(t *testing.T) {
+	src := t.TempDir()
+	dst := filepath.Join(src, "mirror")
+	err := Sync(src, dst, SyncOptions{})
+	if !errors.Is(err, ErrSyncOverlap) {
+		t.Fatalf("got %v, want ErrSyncOverlap", err)
+	}
+	missing(t, src, "mirror")
+}
+
+func TestSyncContinuous(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	write(t, src, "a", "one")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- SyncContext(ctx, src, dst, SyncOptions{Continuous: true, Interval: 20 * time.Millisecond})
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v once stopped, want context.Canceled", err)
+		}
+	}()
+
+	eventually(t, func() bool {
+		data, err := os.ReadFile(filepath.Join(dst, "a"))
+		return err == nil && string(data) == "one"
+	})
+	if err := os.Rename(filepath.Join(src, "a"), filepath.Join(src, "b")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool {
+		_, err := os.Lstat(filepath.Join(dst, "a"))
+		data, rerr := os.ReadFile(filepath.Join(dst, "b"))
+		return os.IsNotExist(err) && rerr == nil && string(data) == "one"
+	})
+}
+
+// eventually fails the test if ok does not become true in time
+func eventually(t *testing.T, ok func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}